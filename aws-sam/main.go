@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"flag"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 
 type Request struct {
 	Path                  string            `json:"path"`
+	Headers               map[string]string `json:"headers"`
 	QueryStringParameters map[string]string `json:"queryStringParameters"`
 }
 
@@ -27,8 +29,8 @@ type Response struct {
 	IsBase64Encoded bool              `json:"isBase64Encoded"`
 }
 
-func Handler(config *proxy.Configuration) func(*Request) (*Response, error) {
-	return func(request *Request) (*Response, error) {
+func Handler(config *proxy.Configuration) func(context.Context, *Request) (*Response, error) {
+	return func(ctx context.Context, request *Request) (*Response, error) {
 		requestURL, err := url.Parse(request.Path)
 		if err != nil {
 			return &Response{
@@ -46,19 +48,26 @@ func Handler(config *proxy.Configuration) func(*Request) (*Response, error) {
 		}
 		requestURL.RawQuery = parameters.Encode()
 
-		pr, err := proxy.NewRequestFromURL(requestURL)
-		if err != nil {
-			return &Response{
-				StatusCode: http.StatusBadRequest,
-				Headers: map[string]string{
-					"Content-Type": "text/plain",
-				},
-				Body: err.Error(),
-			}, nil
+		header := http.Header{}
+		for k, v := range request.Headers {
+			header.Set(k, v)
 		}
 
 		rec := httptest.NewRecorder()
-		proxy.Proxy(config, rec, pr)
+		if pr, err := proxy.NewRequest(requestURL, header); err != nil {
+			proxy.ServeInvalidRequest(config, rec, request.Path, err)
+		} else {
+			proxy.Proxy(proxy.ExtractTraceContext(ctx, header), config, rec, pr)
+
+			// The function may be frozen as soon as it returns, so spans are exported now.
+			if flusher, ok := config.TracerProvider.(interface {
+				ForceFlush(context.Context) error
+			}); ok {
+				if err := flusher.ForceFlush(ctx); err != nil && config.Logger != nil {
+					config.Logger.WithError(err).Warn("unable to export spans")
+				}
+			}
+		}
 		result := rec.Result()
 		defer result.Body.Close()
 
@@ -88,8 +97,12 @@ func main() {
 		log.Fatal(err)
 	}
 
-	config := &proxy.Configuration{}
-	config.LoadEnvironmentVariables()
+	config := &proxy.Configuration{
+		Logger: proxy.NewLogger(),
+	}
+	if err := config.LoadEnvironmentVariables(); err != nil {
+		log.Fatal(err)
+	}
 
 	lambda.Start(Handler(config))
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/http"
+	"runtime"
+
+	"github.com/theaaf/image-proxy/svg"
+)
+
+// version and revision describe the build. They're set by the Makefile via -ldflags.
+var (
+	version  = "dev"
+	revision = ""
+)
+
+// readinessSVG is rendered by readiness checks. It's a solid red square.
+var readinessSVG = []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="4" height="4"><rect width="4" height="4" fill="#ff0000"/></svg>`)
+
+// checkReadiness verifies that vector images can be rasterized, which fails if librsvg is broken.
+func checkReadiness() error {
+	document, err := svg.New(readinessSVG)
+	if err != nil {
+		return err
+	}
+	defer document.Close()
+	img, err := document.Rasterize(&svg.RasterizeOptions{})
+	if err != nil {
+		return err
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 4 || bounds.Dy() != 4 {
+		return fmt.Errorf("unexpected dimensions: %vx%v", bounds.Dx(), bounds.Dy())
+	}
+	if c := color.RGBAModel.Convert(img.At(2, 2)).(color.RGBA); c != (color.RGBA{R: 0xff, A: 0xff}) {
+		return fmt.Errorf("unexpected color: %v", c)
+	}
+	return nil
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	if err := checkReadiness(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// buildInfo describes the running build, as served at /version.
+type buildInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	info := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Revision:  revision,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
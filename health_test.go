@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/theaaf/image-proxy/proxy"
+)
+
+func TestHTTPHandler_InternalEndpoints(t *testing.T) {
+	handler := httpHandler(&proxy.Configuration{
+		// Nothing should be fetched, so every origin is forbidden.
+		AllowedHosts: []string{"example.com"},
+	}, http.NotFoundHandler())
+
+	for name, tc := range map[string]struct {
+		Path        string
+		ContentType string
+	}{
+		"Health": {
+			Path:        "/healthz",
+			ContentType: "text/plain",
+		},
+		"Readiness": {
+			Path:        "/readyz",
+			ContentType: "text/plain",
+		},
+		"Version": {
+			Path:        "/version",
+			ContentType: "application/json",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", tc.Path, nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tc.ContentType, rec.Header().Get("Content-Type"))
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	var info buildInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+	assert.Equal(t, version, info.Version)
+	assert.Equal(t, revision, info.Revision)
+	assert.NotEmpty(t, info.GoVersion)
+}
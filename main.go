@@ -3,29 +3,73 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/theaaf/image-proxy/proxy"
 )
 
-func httpHandler(config *proxy.Configuration) http.Handler {
+func httpHandler(config *proxy.Configuration, metrics http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		pr, err := proxy.NewRequestFromURL(r.URL)
+		// These paths are reserved for the server itself rather than being treated as origin URLs.
+		switch r.URL.Path {
+		case "/healthz":
+			serveHealth(w, r)
+			return
+		case "/readyz":
+			serveReadiness(w, r)
+			return
+		case "/version":
+			serveVersion(w, r)
+			return
+		case "/metrics":
+			metrics.ServeHTTP(w, r)
+			return
+		}
+
+		pr, err := proxy.NewRequest(r.URL, r.Header)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			proxy.ServeInvalidRequest(config, w, r.URL.Path, err)
 			return
 		}
-		proxy.Proxy(config, w, pr)
+		proxy.Proxy(proxy.ExtractTraceContext(r.Context(), r.Header), config, w, pr)
 	})
 }
 
 func main() {
-	config := &proxy.Configuration{}
-	config.LoadEnvironmentVariables()
+	config := &proxy.Configuration{
+		Logger: proxy.NewLogger(),
+	}
+	if err := config.LoadEnvironmentVariables(); err != nil {
+		log.Fatal(err)
+	}
+
+	if dir := os.Getenv("IMAGE_PROXY_DISK_CACHE_DIR"); dir != "" {
+		size := int64(1 << 30)
+		if param := os.Getenv("IMAGE_PROXY_DISK_CACHE_SIZE"); param != "" {
+			n, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				log.Fatal("invalid IMAGE_PROXY_DISK_CACHE_SIZE")
+			}
+			size = n
+		}
+		cache, err := proxy.NewDiskCache(dir, size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.DiskCache = cache
+	}
+
+	config.Metrics = proxy.NewMetrics(config)
+	prometheus.MustRegister(config.Metrics)
 
 	s := &http.Server{
 		Addr:    ":8080",
-		Handler: httpHandler(config),
+		Handler: httpHandler(config, promhttp.Handler()),
 	}
-	log.Print("listenting at http://127.0.0.1:8080")
+	config.Logger.Info("listening at http://127.0.0.1:8080")
 	log.Fatal(s.ListenAndServe())
 }
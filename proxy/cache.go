@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheParameters are the query parameters that affect the response to a request.
+var cacheParameters = []string{
+	"background",
+	"colors",
+	"compression",
+	"crop",
+	"fill",
+	"fit",
+	"flip",
+	"focus",
+	"format",
+	"frame",
+	"lossless",
+	"orient",
+	"quality",
+	"rasterize",
+	"rect",
+	"rotate",
+	"upscale",
+}
+
+// transformationParameters returns the normalized query parameters that affect the response.
+func transformationParameters(query url.Values) url.Values {
+	params := url.Values{}
+	for _, name := range cacheParameters {
+		if v, ok := query[name]; ok {
+			params[name] = v
+		}
+	}
+	if params.Get("format") == "jpg" {
+		params.Set("format", "jpeg")
+	}
+	return params
+}
+
+// cacheKey returns a key that's the same for all requests that produce the same response.
+func cacheKey(originURL *url.URL, query url.Values, header http.Header) string {
+	params := transformationParameters(query)
+	key := originURL.String() + "?" + params.Encode()
+	if params.Get("format") == "auto" && acceptsMediaType(header.Get("Accept"), "image/webp") {
+		key += " image/webp"
+	}
+	return key
+}
+
+// result is the complete response to a proxy request.
+type result struct {
+	Header http.Header
+	Body   []byte
+
+	// Validators are the origin image's ETag and Last-Modified headers, which are used to
+	// revalidate the result with the origin once it's stale.
+	Validators http.Header
+
+	// notModified is true if the result is a 304 Not Modified response to a conditional request.
+	// Such results are never cached.
+	notModified bool
+
+	// cached is when the result was cached, if it came from a cache.
+	cached time.Time
+}
+
+// write writes the result to w, or 304 Not Modified if the request's conditional headers are
+// satisfied. Results may be shared, so w gets its own copy of the header. Cached results carry an
+// Age header so that downstream caches don't count their lifetime from the start again.
+func (r *result) write(w http.ResponseWriter, request http.Header) {
+	if !r.cached.IsZero() {
+		age := time.Since(r.cached) / time.Second
+		if age < 0 {
+			age = 0
+		}
+		w.Header().Set("Age", strconv.FormatInt(int64(age), 10))
+	}
+
+	if r.notModified || notModified(request, r.Header) {
+		for _, name := range notModifiedHeaders {
+			canonical := textproto.CanonicalMIMEHeaderKey(name)
+			if v, ok := r.Header[canonical]; ok {
+				w.Header()[canonical] = append([]string(nil), v...)
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	for k, v := range r.Header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Write(r.Body)
+}
+
+func (r *result) size() int64 {
+	n := int64(len(r.Body))
+	for k, v := range r.Header {
+		n += int64(len(k))
+		for _, s := range v {
+			n += int64(len(s))
+		}
+	}
+	return n
+}
+
+// originValidators returns the headers of an origin response that can be used to revalidate it.
+func originValidators(header http.Header) http.Header {
+	validators := http.Header{}
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		if v := header.Get(name); v != "" {
+			validators.Set(name, v)
+		}
+	}
+	return validators
+}
+
+// revalidatedHeaders are the headers that are updated when a stale response is revalidated.
+var revalidatedHeaders = []string{
+	"Cache-Control",
+	"Expires",
+}
+
+// refreshed returns a copy of a stale result with the headers of a 304 Not Modified response from
+// the origin, so that it's fresh again.
+func (r *result) refreshed(header http.Header) *result {
+	out := &result{
+		Header:     http.Header{},
+		Body:       r.Body,
+		Validators: r.Validators,
+	}
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	for _, name := range revalidatedHeaders {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if v, ok := header[canonical]; ok {
+			out.Header[canonical] = v
+		}
+	}
+	return out
+}
+
+// freshnessLifetime returns how long a response may be cached according to its Cache-Control and
+// Expires headers. It's zero if the response must not be cached.
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return 0
+		}
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(now) {
+			return 0
+		}
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// parseCacheControl parses a Cache-Control header into its directives and their values.
+func parseCacheControl(header string) map[string]string {
+	directives := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value := parseCacheDirective(part)
+		directives[name] = value
+	}
+	return directives
+}
+
+// parseCacheDirective parses a Cache-Control directive into its lowercase name and its value.
+func parseCacheDirective(directive string) (string, string) {
+	name, value := directive, ""
+	if i := strings.Index(directive, "="); i >= 0 {
+		name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+	}
+	return strings.ToLower(strings.TrimSpace(name)), value
+}
+
+// Cache is an in-memory LRU cache of proxy responses, bounded by the total size of the responses.
+// Responses are only cached for as long as their Cache-Control or Expires headers allow. A nil
+// *Cache caches nothing.
+type Cache struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	key     string
+	result  *result
+	expires time.Time
+}
+
+// CacheStats describes the effectiveness of a Cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// NewCache creates a cache that holds up to maxBytes of responses.
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Stats returns the cache's current statistics.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.size
+	return stats
+}
+
+// get returns the fresh cached result for key, if any.
+func (c *Cache) get(key string, now time.Time) *result {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		// Stale results are kept until they're evicted so that they can be revalidated.
+		c.stats.Misses++
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	c.stats.Hits++
+	return entry.result
+}
+
+// stale returns the cached result for key, if any, even if it's no longer fresh.
+func (c *Cache) stale(key string) *result {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		return element.Value.(*cacheEntry).result
+	}
+	return nil
+}
+
+// add caches r for key if its headers allow it to be cached.
+func (c *Cache) add(key string, r *result, now time.Time) {
+	if c == nil {
+		return
+	}
+	lifetime := freshnessLifetime(r.Header, now)
+	if lifetime <= 0 || r.size() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The result may be shared, so the cached time is recorded on a copy.
+	cached := *r
+	cached.cached = now
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{
+		key:     key,
+		result:  &cached,
+		expires: now.Add(lifetime),
+	})
+	c.size += r.size()
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.result.size()
+}
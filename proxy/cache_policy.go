@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CachePolicy overrides the caching headers of responses. Zero durations are ignored.
+type CachePolicy struct {
+	// MinTTL and MaxTTL bound the lifetime given by the origin's Cache-Control or Expires headers.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// DefaultTTL is used if the origin doesn't specify a lifetime.
+	DefaultTTL time.Duration
+
+	// ErrorTTL is the lifetime of error responses, which are otherwise sent without caching headers.
+	ErrorTTL time.Duration
+}
+
+// HostCachePolicy is a CachePolicy for origin hosts that match a pattern, as in AllowedHosts.
+type HostCachePolicy struct {
+	Pattern string
+	CachePolicy
+}
+
+// cachePolicy returns the cache policy for an origin host. The fields set by the first matching
+// host policy override those of the default policy. It returns nil if there's no policy.
+func (c *Configuration) cachePolicy(host string) *CachePolicy {
+	for _, policy := range c.HostCachePolicies {
+		if ok, err := filepath.Match(policy.Pattern, host); err == nil && ok {
+			return policy.CachePolicy.over(c.CachePolicy)
+		}
+	}
+	return c.CachePolicy
+}
+
+// over returns a copy of base with the non-zero fields of p.
+func (p CachePolicy) over(base *CachePolicy) *CachePolicy {
+	var merged CachePolicy
+	if base != nil {
+		merged = *base
+	}
+	if p.MinTTL != 0 {
+		merged.MinTTL = p.MinTTL
+	}
+	if p.MaxTTL != 0 {
+		merged.MaxTTL = p.MaxTTL
+	}
+	if p.DefaultTTL != 0 {
+		merged.DefaultTTL = p.DefaultTTL
+	}
+	if p.ErrorTTL != 0 {
+		merged.ErrorTTL = p.ErrorTTL
+	}
+	return &merged
+}
+
+// apply rewrites the caching headers of a successful response according to the policy. The max-age
+// and s-maxage directives are bounded separately, and other directives are kept. Responses that the
+// origin forbids caching are left untouched.
+func (p *CachePolicy) apply(header http.Header, now time.Time) {
+	if p == nil {
+		return
+	}
+
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return
+		}
+	}
+
+	bound := func(lifetime time.Duration) int64 {
+		if lifetime < p.MinTTL {
+			lifetime = p.MinTTL
+		}
+		if p.MaxTTL > 0 && lifetime > p.MaxTTL {
+			lifetime = p.MaxTTL
+		}
+		return int64(lifetime / time.Second)
+	}
+
+	var parts []string
+	hasLifetime := false
+	for _, part := range strings.Split(header.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if name, value := parseCacheDirective(part); name == "max-age" || name == "s-maxage" {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < 0 {
+				seconds = 0
+			}
+			part = fmt.Sprintf("%v=%d", name, bound(time.Duration(seconds)*time.Second))
+			hasLifetime = true
+		}
+		parts = append(parts, part)
+	}
+
+	if !hasLifetime {
+		lifetime := p.DefaultTTL
+		if header.Get("Expires") != "" {
+			lifetime = freshnessLifetime(header, now)
+		} else if p.DefaultTTL <= 0 {
+			return
+		}
+		parts = append(parts, fmt.Sprintf("max-age=%d", bound(lifetime)))
+	}
+
+	header.Set("Cache-Control", strings.Join(parts, ", "))
+	header.Del("Expires")
+}
+
+// writeError writes an error response, with caching headers if the policy has an ErrorTTL.
+func (p *CachePolicy) writeError(w http.ResponseWriter, message string, statusCode int) {
+	if p != nil && p.ErrorTTL > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(p.ErrorTTL/time.Second)))
+	}
+	http.Error(w, message, statusCode)
+}
+
+// parseCachePolicy parses a policy given as semicolon-separated fields such as "min=1m;max=1h".
+// The field names are min, max, default, and error.
+func parseCachePolicy(s string) (*CachePolicy, error) {
+	policy := &CachePolicy{}
+	for _, field := range strings.Split(s, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid cache policy field: %v", field)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache policy duration: %v", parts[1])
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "min":
+			policy.MinTTL = d
+		case "max":
+			policy.MaxTTL = d
+		case "default":
+			policy.DefaultTTL = d
+		case "error":
+			policy.ErrorTTL = d
+		default:
+			return nil, fmt.Errorf("invalid cache policy field: %v", field)
+		}
+	}
+	return policy, nil
+}
+
+// parseHostCachePolicies parses comma-separated host policies, each of which is a host pattern
+// followed by the policy's fields, such as "*.example.com;min=1m;max=1h".
+func parseHostCachePolicies(s string) ([]HostCachePolicy, error) {
+	var policies []HostCachePolicy
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ";", 2)
+		fields := ""
+		if len(parts) == 2 {
+			fields = parts[1]
+		}
+		policy, err := parseCachePolicy(fields)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, HostCachePolicy{
+			Pattern:     strings.TrimSpace(parts[0]),
+			CachePolicy: *policy,
+		})
+	}
+	return policies, nil
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachePolicy_Apply(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	policy := &CachePolicy{
+		MinTTL:     time.Minute,
+		MaxTTL:     time.Hour,
+		DefaultTTL: 10 * time.Minute,
+	}
+
+	for name, tc := range map[string]struct {
+		Header   http.Header
+		Expected string
+	}{
+		"Default": {
+			Header:   http.Header{},
+			Expected: "max-age=600",
+		},
+		"Within": {
+			Header:   http.Header{"Cache-Control": []string{"public, max-age=120"}},
+			Expected: "public, max-age=120",
+		},
+		"BelowMin": {
+			Header:   http.Header{"Cache-Control": []string{"max-age=0"}},
+			Expected: "max-age=60",
+		},
+		"AboveMax": {
+			Header:   http.Header{"Cache-Control": []string{"max-age=86400"}},
+			Expected: "max-age=3600",
+		},
+		"SharedMaxAge": {
+			Header:   http.Header{"Cache-Control": []string{"public, max-age=30, s-maxage=86400, immutable"}},
+			Expected: "public, max-age=60, s-maxage=3600, immutable",
+		},
+		"Expires": {
+			Header:   http.Header{"Expires": []string{now.Add(30 * time.Minute).Format(http.TimeFormat)}},
+			Expected: "max-age=1800",
+		},
+		"ExpiresWithDirectives": {
+			Header: http.Header{
+				"Cache-Control": []string{"public"},
+				"Expires":       []string{now.Add(2 * time.Hour).Format(http.TimeFormat)},
+			},
+			Expected: "public, max-age=3600",
+		},
+		"NoStore": {
+			Header:   http.Header{"Cache-Control": []string{"no-store"}},
+			Expected: "no-store",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			policy.apply(tc.Header, now)
+			assert.Equal(t, tc.Expected, tc.Header.Get("Cache-Control"))
+			assert.Empty(t, tc.Header.Get("Expires"))
+		})
+	}
+}
+
+func TestParseHostCachePolicies(t *testing.T) {
+	policies, err := parseHostCachePolicies("*.example.com;min=1m;max=1h, foo.com;default=5m;error=30s")
+	require.NoError(t, err)
+	assert.Equal(t, []HostCachePolicy{
+		{Pattern: "*.example.com", CachePolicy: CachePolicy{MinTTL: time.Minute, MaxTTL: time.Hour}},
+		{Pattern: "foo.com", CachePolicy: CachePolicy{DefaultTTL: 5 * time.Minute, ErrorTTL: 30 * time.Second}},
+	}, policies)
+
+	_, err = parseHostCachePolicies("foo.com;min=forever")
+	assert.Error(t, err)
+
+	_, err = parseCachePolicy("ttl=1m")
+	assert.Error(t, err)
+}
+
+func TestProxy_CachePolicy(t *testing.T) {
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+	config.CachePolicy = &CachePolicy{
+		DefaultTTL: time.Hour,
+		ErrorTTL:   time.Minute,
+	}
+
+	result := proxyTestRequest(t, config, server, "/foo.png", nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, "max-age=3600", result.Header.Get("Cache-Control"))
+
+	result = proxyTestRequest(t, config, server, "/missing.png", nil)
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Equal(t, "max-age=60", result.Header.Get("Cache-Control"))
+
+	config.HostCachePolicies = []HostCachePolicy{
+		{Pattern: "127.0.0.1:*", CachePolicy: CachePolicy{DefaultTTL: time.Minute}},
+	}
+
+	result = proxyTestRequest(t, config, server, "/foo.png", nil)
+	assert.Equal(t, "max-age=60", result.Header.Get("Cache-Control"))
+
+	result = proxyTestRequest(t, config, server, "/missing.png", nil)
+	assert.Equal(t, "max-age=60", result.Header.Get("Cache-Control"))
+}
+
+func TestConfiguration_CachePolicy(t *testing.T) {
+	config := &Configuration{
+		CachePolicy: &CachePolicy{MinTTL: time.Minute, DefaultTTL: time.Hour, ErrorTTL: 30 * time.Second},
+		HostCachePolicies: []HostCachePolicy{
+			{Pattern: "*.example.com", CachePolicy: CachePolicy{MaxTTL: time.Hour, ErrorTTL: time.Minute}},
+		},
+	}
+
+	assert.Equal(t, &CachePolicy{
+		MinTTL:     time.Minute,
+		MaxTTL:     time.Hour,
+		DefaultTTL: time.Hour,
+		ErrorTTL:   time.Minute,
+	}, config.cachePolicy("img.example.com"))
+	assert.Equal(t, config.CachePolicy, config.cachePolicy("foo.com"))
+
+	config.CachePolicy = nil
+	assert.Equal(t, &config.HostCachePolicies[0].CachePolicy, config.cachePolicy("img.example.com"))
+	assert.Nil(t, config.cachePolicy("foo.com"))
+}
+
+func TestServeInvalidRequest_CachePolicy(t *testing.T) {
+	config := &Configuration{
+		CachePolicy: &CachePolicy{ErrorTTL: time.Minute},
+		HostCachePolicies: []HostCachePolicy{
+			{Pattern: "static.example.com", CachePolicy: CachePolicy{ErrorTTL: time.Hour}},
+		},
+	}
+
+	for path, expected := range map[string]string{
+		"/example.com/foo.png":        "max-age=60",
+		"/static.example.com/foo.png": "max-age=3600",
+	} {
+		rec := httptest.NewRecorder()
+		ServeInvalidRequest(config, rec, path, fmt.Errorf("invalid fit"))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Equal(t, expected, rec.Header().Get("Cache-Control"), path)
+	}
+}
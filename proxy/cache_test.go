@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	key := func(rawurl string, header http.Header) string {
+		u, err := url.Parse(rawurl)
+		require.NoError(t, err)
+		r, err := NewRequest(u, header)
+		require.NoError(t, err)
+		return r.CacheKey()
+	}
+
+	assert.Equal(t, key("/foo.example.com/foo.png?fit=10x10&format=jpg", nil), key("/foo.example.com/foo.png?format=jpeg&fit=10x10&utm_source=bar", nil))
+	assert.NotEqual(t, key("/foo.example.com/foo.png?fit=10x10", nil), key("/foo.example.com/foo.png?fit=20x20", nil))
+	assert.NotEqual(t, key("/foo.example.com/foo.png?fit=10x10", nil), key("/foo.example.com/bar.png?fit=10x10", nil))
+
+	webp := http.Header{"Accept": []string{"image/webp,*/*"}}
+	other := http.Header{"Accept": []string{"image/png,*/*"}}
+	assert.NotEqual(t, key("/foo.example.com/foo.png?format=auto", webp), key("/foo.example.com/foo.png?format=auto", other))
+	assert.Equal(t, key("/foo.example.com/foo.png?format=auto", other), key("/foo.example.com/foo.png?format=auto", nil))
+	assert.Equal(t, key("/foo.example.com/foo.png", webp), key("/foo.example.com/foo.png", nil))
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		Header   http.Header
+		Expected time.Duration
+	}{
+		"None": {
+			Header:   http.Header{},
+			Expected: 0,
+		},
+		"MaxAge": {
+			Header:   http.Header{"Cache-Control": []string{"public, max-age=60"}},
+			Expected: time.Minute,
+		},
+		"SharedMaxAge": {
+			Header:   http.Header{"Cache-Control": []string{"max-age=60, s-maxage=120"}},
+			Expected: 2 * time.Minute,
+		},
+		"NoStore": {
+			Header:   http.Header{"Cache-Control": []string{"no-store, max-age=60"}},
+			Expected: 0,
+		},
+		"Private": {
+			Header:   http.Header{"Cache-Control": []string{"private, max-age=60"}},
+			Expected: 0,
+		},
+		"Expires": {
+			Header:   http.Header{"Expires": []string{now.Add(time.Hour).Format(http.TimeFormat)}},
+			Expected: time.Hour,
+		},
+		"Expired": {
+			Header:   http.Header{"Expires": []string{now.Add(-time.Hour).Format(http.TimeFormat)}},
+			Expected: 0,
+		},
+		"MaxAgeOverridesExpires": {
+			Header: http.Header{
+				"Cache-Control": []string{"max-age=60"},
+				"Expires":       []string{now.Add(time.Hour).Format(http.TimeFormat)},
+			},
+			Expected: time.Minute,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, freshnessLifetime(tc.Header, now))
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	newResult := func(size int) *result {
+		return &result{
+			Header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:   make([]byte, size),
+		}
+	}
+
+	cache := NewCache(3000)
+	cache.add("a", newResult(1000), now)
+	cache.add("b", newResult(1000), now)
+	assert.NotNil(t, cache.get("a", now))
+	cache.add("c", newResult(1000), now)
+
+	assert.Nil(t, cache.get("b", now))
+	assert.NotNil(t, cache.get("a", now))
+	assert.NotNil(t, cache.get("c", now))
+	assert.Nil(t, cache.get("a", now.Add(time.Minute)))
+	assert.NotNil(t, cache.stale("a"))
+
+	cache.add("d", newResult(5000), now)
+	assert.Nil(t, cache.get("d", now))
+
+	cache.add("e", &result{Body: make([]byte, 10)}, now)
+	assert.Nil(t, cache.get("e", now))
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+}
+
+func TestCache_Age(t *testing.T) {
+	cache := NewCache(1 << 20)
+	cache.add("a", &result{
+		Header: http.Header{"Cache-Control": []string{"max-age=60"}},
+	}, time.Now().Add(-30*time.Second))
+
+	rec := httptest.NewRecorder()
+	cache.get("a", time.Now()).write(rec, nil)
+	assert.Equal(t, "30", rec.Header().Get("Age"))
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+}
+
+func TestProxy_Cache(t *testing.T) {
+	var fetches int32
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		image.ServeHTTP(w, r)
+	}))
+	config.Cache = NewCache(1 << 20)
+
+	for i := 0; i < 2; i++ {
+		result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, "max-age=60", result.Header.Get("Cache-Control"))
+		if i == 0 {
+			assert.Empty(t, result.Header.Get("Age"))
+		} else {
+			assert.Equal(t, "0", result.Header.Get("Age"))
+		}
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	result := proxyTestRequest(t, config, server, "/foo.png?fit=20x20", nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	stats := config.Cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+}
+
+func TestProxy_Revalidation(t *testing.T) {
+	var fetches, notModified int32
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.Header().Set("Cache-Control", "max-age=120")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+	config.Cache = NewCache(1 << 20)
+
+	result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	etag := result.Header.Get("ETag")
+
+	// Make the cached result stale.
+	u, err := url.Parse("/" + strings.TrimPrefix(server.URL, "https://") + "/foo.png?fit=10x10")
+	require.NoError(t, err)
+	request, err := NewRequest(u, nil)
+	require.NoError(t, err)
+	config.Cache.add(request.CacheKey(), config.Cache.stale(request.CacheKey()), time.Now().Add(-time.Hour))
+
+	result = proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, etag, result.Header.Get("ETag"))
+	assert.Equal(t, "max-age=120", result.Header.Get("Cache-Control"))
+	body, err := ioutil.ReadAll(result.Body)
+	require.NoError(t, err)
+	_, err = png.Decode(bytes.NewReader(body))
+	assert.NoError(t, err)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+
+	// The refreshed result is fresh again.
+	result = proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls with the same key into a single call whose result is
+// shared by all callers.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+
+	// joined, if non-nil, is called whenever a caller joins a flight. Tests use it to wait until
+	// their requests have been coalesced.
+	joined func(key string)
+}
+
+type flight struct {
+	done   sync.WaitGroup
+	result *result
+	err    *FilterError
+}
+
+// do calls fn unless a call with the same key is already in flight, in which case it waits for that
+// call to finish and returns its result. shared is true if the result came from another caller's
+// call. If fn panics, every caller gets a 500 error.
+func (g *flightGroup) do(key string, fn func() (*result, *FilterError)) (result *result, err *FilterError, shared bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = map[string]*flight{}
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		if g.joined != nil {
+			g.joined(key)
+		}
+		f.done.Wait()
+		return f.result, f.err, true
+	}
+	f := &flight{}
+	f.done.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		if v := recover(); v != nil {
+			f.result, f.err = nil, &FilterError{
+				Error:      fmt.Errorf("panic: %v", v),
+				StatusCode: http.StatusInternalServerError,
+			}
+			result, err = f.result, f.err
+		}
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		f.done.Done()
+	}()
+
+	f.result, f.err = fn()
+	return f.result, f.err, false
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Coalescing(t *testing.T) {
+	const requests = 5
+
+	var fetches int32
+	started := make(chan struct{}, requests)
+	release := make(chan struct{})
+	joined := make(chan struct{}, requests)
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		started <- struct{}{}
+		<-release
+		image.ServeHTTP(w, r)
+	}))
+	config.flights.joined = func(string) {
+		joined <- struct{}{}
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*http.Response, requests)
+	proxy := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		}()
+	}
+
+	// The other requests are made once the first one is blocked on the origin, and they should join
+	// its flight rather than fetching the image themselves.
+	proxy(0)
+	<-started
+	for i := 1; i < requests; i++ {
+		proxy(i)
+	}
+	for i := 1; i < requests; i++ {
+		<-joined
+	}
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	for _, result := range results {
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, "image/png", result.Header.Get("Content-Type"))
+	}
+}
+
+func TestFlightGroup_Panic(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g := flightGroup{
+		joined: func(string) {
+			close(release)
+		},
+	}
+	done := make(chan *FilterError)
+	go func() {
+		_, err, _ := g.do("foo", func() (*result, *FilterError) {
+			close(started)
+			<-release
+			panic("foo")
+		})
+		done <- err
+	}()
+
+	// Join the flight once it's started. It panics as soon as it's been joined.
+	<-started
+	res, err, shared := g.do("foo", func() (*result, *FilterError) {
+		t.Error("the flight should have been joined")
+		return nil, nil
+	})
+	assert.True(t, shared)
+	assert.Nil(t, res)
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, err.StatusCode)
+
+	err = <-done
+	require.NotNil(t, err)
+	assert.Equal(t, http.StatusInternalServerError, err.StatusCode)
+
+	// The flight is over, so the next call makes its own.
+	res, err, shared = g.do("foo", func() (*result, *FilterError) {
+		return &result{}, nil
+	})
+	assert.False(t, shared)
+	assert.NotNil(t, res)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// notModifiedHeaders are the headers of a full response that are also sent with 304 Not Modified.
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+// entityTag returns the ETag of a response. It's derived from the origin image's ETag, or its
+// content if it has none, and the request's cache key, which identifies the transformation. It's
+// weak if the origin image's ETag is, since the origin image may then change without a new ETag.
+func entityTag(origin *result, cacheKey string) string {
+	validator := origin.Header.Get("ETag")
+	if validator == "" {
+		sum := sha256.Sum256(origin.Body)
+		validator = hex.EncodeToString(sum[:])
+	}
+	sum := sha256.Sum256([]byte(validator + "\n" + cacheKey))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if strings.HasPrefix(validator, "W/") {
+		etag = "W/" + etag
+	}
+	return etag
+}
+
+// isConditional reports whether a request has conditional headers.
+func isConditional(request http.Header) bool {
+	return request.Get("If-None-Match") != "" || request.Get("If-Modified-Since") != ""
+}
+
+// notModified reports whether the conditional headers of a request are satisfied by a response with
+// the given header, meaning that 304 Not Modified can be sent instead. As with other GET requests,
+// If-Modified-Since is ignored if If-None-Match is given.
+func notModified(request, response http.Header) bool {
+	if ifNoneMatch := request.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(response.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := request.Get("If-Modified-Since"); ifModifiedSince != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		if err != nil {
+			return false
+		}
+		lastModified, err := http.ParseTime(response.Get("Last-Modified"))
+		if err != nil {
+			return false
+		}
+		return !lastModified.After(since)
+	}
+
+	return false
+}
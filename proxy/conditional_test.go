@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntityTag(t *testing.T) {
+	strong := entityTag(&result{Header: http.Header{"Etag": []string{`"foo"`}}}, "key")
+	assert.True(t, strings.HasPrefix(strong, `"`))
+
+	weak := entityTag(&result{Header: http.Header{"Etag": []string{`W/"foo"`}}}, "key")
+	assert.True(t, strings.HasPrefix(weak, `W/"`))
+
+	content := entityTag(&result{Header: http.Header{}, Body: []byte("foo")}, "key")
+	assert.True(t, strings.HasPrefix(content, `"`))
+	assert.NotEqual(t, content, entityTag(&result{Header: http.Header{}, Body: []byte("foo")}, "other key"))
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	response := http.Header{
+		"Last-Modified": []string{lastModified.Format(http.TimeFormat)},
+	}
+	response.Set("ETag", `"foo"`)
+
+	for name, tc := range map[string]struct {
+		Request  http.Header
+		Expected bool
+	}{
+		"Unconditional": {
+			Request:  http.Header{},
+			Expected: false,
+		},
+		"MatchingETag": {
+			Request:  http.Header{"If-None-Match": []string{`"bar", "foo"`}},
+			Expected: true,
+		},
+		"WeakETag": {
+			Request:  http.Header{"If-None-Match": []string{`W/"foo"`}},
+			Expected: true,
+		},
+		"Wildcard": {
+			Request:  http.Header{"If-None-Match": []string{"*"}},
+			Expected: true,
+		},
+		"MismatchedETag": {
+			Request:  http.Header{"If-None-Match": []string{`"bar"`}},
+			Expected: false,
+		},
+		"NotModifiedSince": {
+			Request:  http.Header{"If-Modified-Since": []string{lastModified.Format(http.TimeFormat)}},
+			Expected: true,
+		},
+		"ModifiedSince": {
+			Request:  http.Header{"If-Modified-Since": []string{lastModified.Add(-time.Hour).Format(http.TimeFormat)}},
+			Expected: false,
+		},
+		"ETagTakesPrecedence": {
+			Request: http.Header{
+				"If-None-Match":     []string{`"bar"`},
+				"If-Modified-Since": []string{lastModified.Format(http.TimeFormat)},
+			},
+			Expected: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, notModified(tc.Request, response))
+		})
+	}
+}
+
+func TestProxy_ConditionalRequests(t *testing.T) {
+	lastModified := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", lastModified)
+		w.Header().Set("Cache-Control", "max-age=60")
+		image.ServeHTTP(w, r)
+	}))
+
+	result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	etag := result.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	other := proxyTestRequest(t, config, server, "/foo.png?fit=20x20", nil)
+	assert.NotEqual(t, etag, other.Header.Get("ETag"))
+
+	t.Run("IfNoneMatch", func(t *testing.T) {
+		u, err := url.Parse("/" + strings.TrimPrefix(server.URL, "https://") + "/foo.png?fit=10x10")
+		require.NoError(t, err)
+		request, err := NewRequest(u, http.Header{"If-None-Match": []string{etag}})
+		require.NoError(t, err)
+
+		// The filters shouldn't run if the origin image hasn't changed.
+		var filtered int32
+		request.Filters = append([]NamedFilter{{
+			Name: "count",
+			Filter: func(in *Response) (*Response, *FilterError) {
+				atomic.AddInt32(&filtered, 1)
+				return in, nil
+			},
+		}}, request.Filters...)
+
+		rec := httptest.NewRecorder()
+		Proxy(context.Background(), config, rec, request)
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, etag, rec.Header().Get("ETag"))
+		assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+		assert.Empty(t, rec.Body.Bytes())
+		assert.Equal(t, int32(0), atomic.LoadInt32(&filtered))
+	})
+
+	t.Run("IfModifiedSince", func(t *testing.T) {
+		result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", http.Header{
+			"If-Modified-Since": []string{lastModified},
+		})
+		assert.Equal(t, http.StatusNotModified, result.StatusCode)
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		config.Cache = NewCache(1 << 20)
+		defer func() {
+			config.Cache = nil
+		}()
+
+		result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, etag, result.Header.Get("ETag"))
+
+		result = proxyTestRequest(t, config, server, "/foo.png?fit=10x10", http.Header{
+			"If-None-Match": []string{etag},
+		})
+		assert.Equal(t, http.StatusNotModified, result.StatusCode)
+		assert.Equal(t, uint64(1), config.Cache.Stats().Hits)
+	})
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// diskCacheTempPrefix is the prefix of files that are still being written. It's followed by the name
+// of the file being written.
+const diskCacheTempPrefix = ".tmp-"
+
+// DiskCache is a cache of proxy responses and origin images in a directory, bounded by the total
+// size of its files. The least recently used files are evicted first. Entries persist across
+// restarts, and multiple processes may share a directory, though each only accounts for the files
+// it knows about. A nil *DiskCache caches nothing.
+type DiskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+type diskCacheFile struct {
+	name string
+	size int64
+}
+
+// diskCacheEntry is the content of a cache file.
+type diskCacheEntry struct {
+	Key        string
+	Header     http.Header
+	Body       []byte
+	Validators http.Header
+	Expires    time.Time
+	Cached     time.Time
+}
+
+// NewDiskCache creates a cache in dir that holds up to maxBytes of files. Cache files already in dir
+// are kept, and the least recently used ones are evicted if they exceed maxBytes. Other files are
+// left alone.
+func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "unable to create cache directory")
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read cache directory")
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+
+	c := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  map[string]*list.Element{},
+		lru:      list.New(),
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if name := strings.TrimPrefix(info.Name(), diskCacheTempPrefix); name != info.Name() {
+			if len(name) > sha256.Size*2 && isDiskCacheFileName(name[:sha256.Size*2]) {
+				// Left behind by a process that didn't finish writing it.
+				os.Remove(filepath.Join(dir, info.Name()))
+			}
+			continue
+		}
+		if !isDiskCacheFileName(info.Name()) {
+			continue
+		}
+		c.entries[info.Name()] = c.lru.PushBack(&diskCacheFile{
+			name: info.Name(),
+			size: info.Size(),
+		})
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	return c, nil
+}
+
+func diskCacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isDiskCacheFileName reports whether name has the format of the names given by diskCacheFileName.
+func isDiskCacheFileName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range name {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Stats returns the cache's current statistics.
+func (c *DiskCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.size
+	return stats
+}
+
+// get returns the fresh cached result for key, if any.
+func (c *DiskCache) get(key string, now time.Time) *result {
+	if c == nil {
+		return nil
+	}
+	name := diskCacheFileName(key)
+
+	entry, err := c.read(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil || entry.Key != key {
+		c.stats.Misses++
+		return nil
+	}
+	if !now.Before(entry.Expires) {
+		// Stale results are kept until they're evicted so that they can be revalidated.
+		c.stats.Misses++
+		return nil
+	}
+	if element, ok := c.entries[name]; ok {
+		c.lru.MoveToFront(element)
+	}
+	c.stats.Hits++
+	// Persist the access so that the order of eviction survives restarts.
+	os.Chtimes(filepath.Join(c.dir, name), now, now)
+	return entry.result()
+}
+
+// stale returns the cached result for key, if any, even if it's no longer fresh.
+func (c *DiskCache) stale(key string) *result {
+	if c == nil {
+		return nil
+	}
+	entry, err := c.read(diskCacheFileName(key))
+	if err != nil || entry.Key != key {
+		return nil
+	}
+	return entry.result()
+}
+
+func (e *diskCacheEntry) result() *result {
+	return &result{
+		Header:     e.Header,
+		Body:       e.Body,
+		Validators: e.Validators,
+		cached:     e.Cached,
+	}
+}
+
+func (c *DiskCache) read(name string) (*diskCacheEntry, error) {
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entry := &diskCacheEntry{}
+	if err := gob.NewDecoder(f).Decode(entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// add caches r for key if its headers allow it to be cached. Write errors are ignored, leaving the
+// result uncached.
+func (c *DiskCache) add(key string, r *result, now time.Time) {
+	if c == nil {
+		return
+	}
+	lifetime := freshnessLifetime(r.Header, now)
+	if lifetime <= 0 {
+		return
+	}
+
+	name := diskCacheFileName(key)
+	size, err := c.write(name, &diskCacheEntry{
+		Key:        key,
+		Header:     r.Header,
+		Body:       r.Body,
+		Validators: r.Validators,
+		Expires:    now.Add(lifetime),
+		Cached:     now,
+	})
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[name]; ok {
+		c.lru.Remove(element)
+		c.size -= element.Value.(*diskCacheFile).size
+	}
+	c.entries[name] = c.lru.PushFront(&diskCacheFile{
+		name: name,
+		size: size,
+	})
+	c.size += size
+	c.evict()
+}
+
+// write writes the entry to a temporary file, then renames it into place so that readers never see
+// a partially written file.
+func (c *DiskCache) write(name string, entry *diskCacheEntry) (int64, error) {
+	f, err := ioutil.TempFile(c.dir, diskCacheTempPrefix+name+"-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	if err := gob.NewEncoder(f).Encode(entry); err != nil {
+		f.Close()
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(c.dir, name)); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// evict removes the least recently used files until the cache fits within its maximum size. The
+// caller must hold c.mu.
+func (c *DiskCache) evict() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes a file from the cache. The caller must hold c.mu.
+func (c *DiskCache) remove(element *list.Element) {
+	file := c.lru.Remove(element).(*diskCacheFile)
+	delete(c.entries, file.name)
+	c.size -= file.size
+	os.Remove(filepath.Join(c.dir, file.name))
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDiskCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "image-proxy-test")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := newTestDiskCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	newResult := func(size int) *result {
+		return &result{
+			Header: http.Header{"Cache-Control": []string{"max-age=60"}},
+			Body:   make([]byte, size),
+		}
+	}
+
+	cache, err := NewDiskCache(dir, 2500)
+	require.NoError(t, err)
+
+	cache.add("a", newResult(1000), now)
+	cache.add("b", newResult(1000), now)
+	a := cache.get("a", now)
+	require.NotNil(t, a)
+	assert.Equal(t, "max-age=60", a.Header.Get("Cache-Control"))
+	assert.Len(t, a.Body, 1000)
+	assert.True(t, a.cached.Equal(now.Round(0)))
+
+	cache.add("c", newResult(1000), now)
+	assert.Nil(t, cache.get("b", now))
+	assert.NotNil(t, cache.get("c", now))
+	assert.Nil(t, cache.get("c", now.Add(time.Minute)))
+	assert.NotNil(t, cache.stale("c"))
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, 2, stats.Entries)
+
+	t.Run("Restart", func(t *testing.T) {
+		cache, err := NewDiskCache(dir, 2500)
+		require.NoError(t, err)
+		assert.Equal(t, 2, cache.Stats().Entries)
+		assert.NotNil(t, cache.get("a", now))
+
+		cache, err = NewDiskCache(dir, 100)
+		require.NoError(t, err)
+		assert.Equal(t, 0, cache.Stats().Entries)
+		assert.Nil(t, cache.get("a", now))
+	})
+}
+
+func TestNewDiskCache_ForeignFiles(t *testing.T) {
+	dir := newTestDiskCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	temp := diskCacheTempPrefix + diskCacheFileName("a") + "-123"
+	for _, name := range []string{"README", ".tmp-foo", temp, diskCacheFileName("a")} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 1000), 0600))
+	}
+
+	cache, err := NewDiskCache(dir, 500)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cache.Stats().Entries)
+
+	// Only the cache's own files are evicted or cleaned up.
+	for name, exists := range map[string]bool{
+		"README":               true,
+		".tmp-foo":             true,
+		temp:                   false,
+		diskCacheFileName("a"): false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		assert.Equal(t, exists, err == nil, name)
+	}
+}
+
+func TestProxy_DiskCache(t *testing.T) {
+	dir := newTestDiskCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	var fetches int32
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		image.ServeHTTP(w, r)
+	}))
+
+	var err error
+	config.DiskCache, err = NewDiskCache(dir, 1<<20)
+	require.NoError(t, err)
+
+	for _, query := range []string{"fit=10x10", "fit=10x10", "fit=20x20"} {
+		result := proxyTestRequest(t, config, server, "/foo.png?"+query, nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+
+	// The origin image and both outputs are cached.
+	assert.Equal(t, 3, config.DiskCache.Stats().Entries)
+}
+
+func TestProxy_DiskCacheRevalidation(t *testing.T) {
+	dir := newTestDiskCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	var notModified int32
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2018 00:00:00 GMT")
+		if r.Header.Get("If-Modified-Since") != "" {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+
+	var err error
+	config.DiskCache, err = NewDiskCache(dir, 1<<20)
+	require.NoError(t, err)
+
+	result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+
+	// Make the cached origin image stale, then request a new size of it.
+	originKey := "origin " + server.URL + "/foo.png"
+	origin := config.DiskCache.stale(originKey)
+	require.NotNil(t, origin)
+	config.DiskCache.add(originKey, origin, time.Now().Add(-time.Hour))
+
+	result = proxyTestRequest(t, config, server, "/foo.png?fit=20x20", nil)
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+}
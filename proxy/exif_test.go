@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// orientedJPEG returns a 40x20 JPEG with a red square in its top-left corner and the given EXIF
+// orientation. If order is nil, the image has no EXIF metadata.
+func orientedJPEG(t *testing.T, orientation int, order binary.ByteOrder) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 10, 10), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}))
+	data := buf.Bytes()
+	if order == nil {
+		return data
+	}
+
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], uint16(orientation))
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	return append(out, data[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	assert.Equal(t, 6, jpegOrientation(orientedJPEG(t, 6, binary.BigEndian)))
+	assert.Equal(t, 8, jpegOrientation(orientedJPEG(t, 8, binary.LittleEndian)))
+	assert.Equal(t, 1, jpegOrientation(orientedJPEG(t, 9, binary.LittleEndian)))
+	assert.Equal(t, 1, jpegOrientation(orientedJPEG(t, 0, nil)))
+	assert.Equal(t, 1, jpegOrientation([]byte("foo")))
+
+	data := orientedJPEG(t, 6, binary.BigEndian)
+	assert.Equal(t, 1, jpegOrientation(data[:12]))
+}
+
+func TestOrientationFilter(t *testing.T) {
+	for orientation, tc := range map[int]struct {
+		Width  int
+		Height int
+		Red    image.Point
+	}{
+		1: {40, 20, image.Pt(5, 5)},
+		2: {40, 20, image.Pt(34, 5)},
+		3: {40, 20, image.Pt(34, 14)},
+		4: {40, 20, image.Pt(5, 14)},
+		5: {20, 40, image.Pt(5, 5)},
+		6: {20, 40, image.Pt(14, 5)},
+		7: {20, 40, image.Pt(14, 34)},
+		8: {20, 40, image.Pt(5, 34)},
+	} {
+		t.Run(strconv.Itoa(orientation), func(t *testing.T) {
+			out, err := OrientationFilter(&Response{
+				Header: http.Header{"Content-Type": []string{"image/jpeg"}},
+				Body:   bytes.NewReader(orientedJPEG(t, orientation, binary.BigEndian)),
+			})
+			require.Nil(t, err)
+
+			img, err := decodeResponse(out)
+			require.Nil(t, err)
+			frame := img.Frames[0]
+			assert.Equal(t, tc.Width, frame.Bounds().Dx())
+			assert.Equal(t, tc.Height, frame.Bounds().Dy())
+
+			r, g, b, _ := frame.At(tc.Red.X, tc.Red.Y).RGBA()
+			assert.True(t, r > 0xc000 && g < 0x4000 && b < 0x4000, "expected red at %v", tc.Red)
+
+			if orientation == 1 {
+				assert.Nil(t, out.Image, "upright images shouldn't be decoded")
+			}
+		})
+	}
+}
+
+func TestProxy_Orientation(t *testing.T) {
+	data := orientedJPEG(t, 6, binary.BigEndian)
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	}))
+
+	for query, expected := range map[string]image.Point{
+		"":                        image.Pt(20, 40),
+		"?fit=10x10":              image.Pt(5, 10),
+		"?orient=false&fit=10x10": image.Pt(10, 5),
+		"?orient=false":           image.Pt(40, 20),
+	} {
+		t.Run(query, func(t *testing.T) {
+			result := proxyTestRequest(t, config, server, "/foo.jpg"+query, nil)
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			img, err := jpeg.Decode(bytes.NewReader(body))
+			require.NoError(t, err)
+			assert.Equal(t, expected, img.Bounds().Size())
+		})
+	}
+}
+
+func TestProxy_OrientationSourcePixels(t *testing.T) {
+	data := orientedJPEG(t, 6, binary.BigEndian)
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	}))
+	config.MaxSourcePixels = 39 * 20
+	result := proxyTestRequest(t, config, server, "/foo.jpg", nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+}
@@ -4,40 +4,249 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
+	"math"
 	"mime"
 	"net/http"
 	"net/textproto"
 
-	"github.com/theaaf/image-proxy/svg"
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
+	"github.com/theaaf/image-proxy/svg"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	xwebp "golang.org/x/image/webp"
 )
 
+// Filter transforms a response. Filters that need pixels decode the response body the first time
+// it's needed, and pass the decoded image along in Response.Image. The image is encoded again by
+// the last filter that produces a body, typically EncodeFilter.
 type Filter func(*Response) (*Response, *FilterError)
 
+// NamedFilter is a filter of a request, along with the name it's reported as in metrics and traces.
+type NamedFilter struct {
+	Name   string
+	Filter Filter
+}
+
 type FilterError struct {
 	Error      error
 	StatusCode int
 }
 
-func RasterizeFilter(scalingFunction ScalingFunction) Filter {
-	return func(in *Response) (*Response, *FilterError) {
-		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
-		if contentType != "image/svg+xml" {
-			return in, nil
+// decoders maps the raster content types we accept to their decoders.
+var decoders = map[string]func(io.Reader) (image.Image, error){
+	"image/bmp":      bmp.Decode,
+	"image/gif":      gif.Decode,
+	"image/jpeg":     jpeg.Decode,
+	"image/png":      png.Decode,
+	"image/tiff":     tiff.Decode,
+	"image/webp":     xwebp.Decode,
+	"image/x-ms-bmp": bmp.Decode,
+}
+
+var configDecoders = map[string]func(io.Reader) (image.Config, error){
+	"image/bmp":      bmp.DecodeConfig,
+	"image/gif":      gif.DecodeConfig,
+	"image/jpeg":     jpeg.DecodeConfig,
+	"image/png":      png.DecodeConfig,
+	"image/tiff":     tiff.DecodeConfig,
+	"image/webp":     xwebp.DecodeConfig,
+	"image/x-ms-bmp": bmp.DecodeConfig,
+}
+
+// decodeImage decodes a raster image. If maxPixels is non-zero, images with more pixels are refused
+// before they're decoded. The pixels of all frames of animated images are counted.
+func decodeImage(contentType string, r io.Reader, maxPixels int64) (*Image, *FilterError) {
+	decode, ok := decoders[contentType]
+	if !ok {
+		return nil, &FilterError{
+			Error:      fmt.Errorf("unsupported content-type"),
+			StatusCode: http.StatusForbidden,
 		}
+	}
 
-		data, err := ioutil.ReadAll(in.Body)
+	if maxPixels > 0 {
+		data, err := ioutil.ReadAll(r)
 		if err != nil {
 			return nil, &FilterError{
 				Error:      err,
 				StatusCode: http.StatusInternalServerError,
 			}
 		}
+		r = bytes.NewReader(data)
+
+		config, err := configDecoders[contentType](bytes.NewReader(data))
+		if err != nil {
+			return nil, &FilterError{
+				Error:      fmt.Errorf("unable to decode image"),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+
+		pixels := int64(config.Width) * int64(config.Height)
+		if contentType == "image/gif" {
+			frames, err := gifFrameCount(data)
+			if err != nil {
+				return nil, &FilterError{
+					Error:      fmt.Errorf("unable to decode image"),
+					StatusCode: http.StatusBadRequest,
+				}
+			}
+			pixels *= int64(frames)
+		}
+		if pixels > maxPixels {
+			return nil, &FilterError{
+				Error:      fmt.Errorf("source image dimensions too large"),
+				StatusCode: statusTooLarge,
+			}
+		}
+	}
+
+	if contentType == "image/gif" {
+		g, err := gif.DecodeAll(r)
+		if err != nil {
+			return nil, &FilterError{
+				Error:      fmt.Errorf("unable to decode image"),
+				StatusCode: http.StatusBadRequest,
+			}
+		}
+		return &Image{
+			Frames:    coalesceGIF(g),
+			Delays:    g.Delay,
+			LoopCount: g.LoopCount,
+		}, nil
+	}
+
+	img, err := decode(r)
+	if err != nil {
+		return nil, &FilterError{
+			Error:      fmt.Errorf("unable to decode image"),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	return &Image{
+		Frames: []image.Image{img},
+	}, nil
+}
+
+// decodeResponse returns the response's image, decoding the body if it hasn't been decoded yet.
+func decodeResponse(in *Response) (*Image, *FilterError) {
+	if in.Image != nil {
+		return in.Image, nil
+	}
+	contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+	return decodeImage(contentType, in.Body, in.config.maxSourcePixels())
+}
+
+// isVector reports whether the response is a vector image that hasn't been rasterized.
+func isVector(in *Response) bool {
+	contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+	return in.Image == nil && contentType == "image/svg+xml"
+}
+
+// encodeImage encodes img in the given raster content type. JPEG and WebP images are encoded with
+// the given quality. Only GIFs retain animation. Other formats use the first frame.
+func encodeImage(contentType string, w io.Writer, img *Image, quality int) *FilterError {
+	var err error
+
+	frame := img.Frames[0]
+
+	switch contentType {
+	case "image/bmp", "image/x-ms-bmp":
+		err = bmp.Encode(w, frame)
+	case "image/gif":
+		if len(img.Frames) > 1 {
+			err = gif.EncodeAll(w, encodeAnimatedGIF(img))
+		} else {
+			err = gif.Encode(w, gifFrame(frame), nil)
+		}
+	case "image/jpeg":
+		err = jpeg.Encode(w, frame, &jpeg.Options{
+			Quality: quality,
+		})
+	case "image/png":
+		err = png.Encode(w, frame)
+	case "image/tiff":
+		err = tiff.Encode(w, frame, &tiff.Options{
+			Compression: tiff.Deflate,
+		})
+	case "image/webp":
+		err = webp.Encode(w, frame, &webp.Options{
+			Quality: float32(quality),
+		})
+	default:
+		return &FilterError{
+			Error:      fmt.Errorf("unsupported content-type"),
+			StatusCode: http.StatusForbidden,
+		}
+	}
+
+	if err != nil {
+		return &FilterError{
+			Error:      fmt.Errorf("unable to encode image"),
+			StatusCode: http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// encodedResponse returns a copy of in with the given encoded body and content type.
+func encodedResponse(in *Response, contentType string, body io.Reader, img *Image) *Response {
+	out := &Response{
+		Header: make(http.Header),
+		Body:   body,
+		Image:  img,
+	}
+
+	for k, v := range in.Header {
+		out.Header[k] = v
+	}
+	out.Header.Set("Content-Type", contentType)
+
+	return out
+}
+
+// imageFilter returns a filter that transforms decoded raster images. Vector images that haven't
+// been rasterized are left untouched.
+func imageFilter(transform func(*Image) (*Image, *FilterError)) Filter {
+	return func(in *Response) (*Response, *FilterError) {
+		if isVector(in) {
+			return in, nil
+		}
+
+		img, filterErr := decodeResponse(in)
+		if filterErr != nil {
+			return nil, filterErr
+		}
+
+		img, filterErr = transform(img)
+		if filterErr != nil {
+			return nil, filterErr
+		}
+
+		return &Response{
+			Header: in.Header,
+			Image:  img,
+		}, nil
+	}
+}
+
+// RasterizeFilter rasterizes vector images. The output dimensions are chosen by scalingFunction,
+// which may upscale the image if allowUpscaling is true. If rect is non-nil, the scaling function and
+// the output limits apply to that region of the image, which ScalingFilter extracts afterwards.
+func RasterizeFilter(scalingFunction ScalingFunction, allowUpscaling bool, rect *Rectangle) Filter {
+	return func(in *Response) (*Response, *FilterError) {
+		if !isVector(in) {
+			return in, nil
+		}
 
-		svg, err := svg.New(data)
+		data, err := ioutil.ReadAll(in.Body)
 		if err != nil {
 			return nil, &FilterError{
 				Error:      err,
@@ -45,16 +254,52 @@ func RasterizeFilter(scalingFunction ScalingFunction) Filter {
 			}
 		}
 
-		image, err := svg.Rasterize(scalingFunction)
+		document, err := svg.New(data)
 		if err != nil {
 			return nil, &FilterError{
 				Error:      err,
 				StatusCode: http.StatusInternalServerError,
 			}
 		}
+		defer document.Close()
+
+		maxWidth, maxHeight := in.config.maxOutputDimensions()
+		scale := 1.0
+		img, err := document.Rasterize(&svg.RasterizeOptions{
+			ScalingFunction: func(width, height int, allowUpscaling bool) (int, int) {
+				naturalWidth, naturalHeight := width, height
+				if rect != nil {
+					region, ok := rect.region(image.Rect(0, 0, width, height), 1)
+					if !ok {
+						// ScalingFilter rejects the region once the image is rasterized.
+						region = image.Rect(0, 0, width, height)
+					}
+					naturalWidth, naturalHeight = region.Dx(), region.Dy()
+				}
 
-		buf := &bytes.Buffer{}
-		if err := png.Encode(buf, image); err != nil {
+				regionWidth, regionHeight := naturalWidth, naturalHeight
+				if scalingFunction != nil {
+					regionWidth, regionHeight = scalingFunction(regionWidth, regionHeight, allowUpscaling)
+				}
+				regionWidth, regionHeight = limitDimensions(regionWidth, regionHeight, maxWidth, maxHeight)
+
+				// The whole image is rasterized at the region's scale.
+				if naturalWidth > 0 && naturalHeight > 0 {
+					scale = float64(regionWidth) / float64(naturalWidth)
+					width = width * regionWidth / naturalWidth
+					height = height * regionHeight / naturalHeight
+				}
+				return width, height
+			},
+			AllowUpscaling: allowUpscaling,
+			MaxPixels:      int(in.config.maxSVGPixels()),
+		})
+		if err == svg.ErrTooLarge {
+			return nil, &FilterError{
+				Error:      fmt.Errorf("rasterized image dimensions too large"),
+				StatusCode: statusTooLarge,
+			}
+		} else if err != nil {
 			return nil, &FilterError{
 				Error:      err,
 				StatusCode: http.StatusInternalServerError,
@@ -63,7 +308,10 @@ func RasterizeFilter(scalingFunction ScalingFunction) Filter {
 
 		out := &Response{
 			Header: make(http.Header),
-			Body:   buf,
+			Image: &Image{
+				Frames: []image.Image{img},
+				scale:  scale,
+			},
 		}
 
 		for k, v := range in.Header {
@@ -78,7 +326,7 @@ func RasterizeFilter(scalingFunction ScalingFunction) Filter {
 func ContentTypeFilter(in *Response) (*Response, *FilterError) {
 	contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
 	switch contentType {
-	case "image/jpeg", "image/png", "image/svg+xml":
+	case "image/bmp", "image/gif", "image/jpeg", "image/png", "image/svg+xml", "image/tiff", "image/webp", "image/x-ms-bmp":
 		header := http.Header{}
 		for k, v := range in.Header {
 			header[k] = v
@@ -86,9 +334,12 @@ func ContentTypeFilter(in *Response) (*Response, *FilterError) {
 		// Make absolutely sure there's only one content-type header so nothing downstream
 		// interprets the content type differently.
 		header.Set("Content-Type", in.Header.Get("Content-Type"))
+		// The origin's Vary header describes how the origin's response varies, not ours.
+		header.Del("Vary")
 		return &Response{
 			Header: header,
 			Body:   in.Body,
+			Image:  in.Image,
 		}, nil
 	}
 
@@ -105,12 +356,14 @@ var forwardedHeaders = []string{
 	"Expires",
 	"Last-Modified",
 	"Pragma",
+	"Vary",
 }
 
 func HeaderFilter(in *Response) (*Response, *FilterError) {
 	out := &Response{
 		Header: http.Header{},
 		Body:   in.Body,
+		Image:  in.Image,
 	}
 	for _, header := range forwardedHeaders {
 		canonical := textproto.CanonicalMIMEHeaderKey(header)
@@ -128,88 +381,340 @@ type Dimensions struct {
 	Height int
 }
 
+// Rectangle is a region of an image. If Relative is true, its coordinates are fractions of the
+// image's dimensions. Otherwise, they're pixels of the source image.
+type Rectangle struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+
+	Relative bool
+}
+
+// region returns the rectangle's region of an image with the given bounds, or false if it's not
+// within the bounds. Pixel coordinates are multiplied by scale, which is the scale of rasterized
+// vector images.
+func (r *Rectangle) region(bounds image.Rectangle, scale float64) (image.Rectangle, bool) {
+	x0, y0, x1, y1 := r.X, r.Y, r.X+r.Width, r.Y+r.Height
+	if r.Relative {
+		if x1 > 1 || y1 > 1 {
+			return image.Rectangle{}, false
+		}
+		x0, x1 = x0*float64(bounds.Dx()), x1*float64(bounds.Dx())
+		y0, y1 = y0*float64(bounds.Dy()), y1*float64(bounds.Dy())
+	} else {
+		if scale == 0 {
+			scale = 1
+		}
+		x0, y0, x1, y1 = x0*scale, y0*scale, x1*scale, y1*scale
+		// Rasterized dimensions are rounded, so allow the region to extend half a pixel past them.
+		if x1 > float64(bounds.Dx())+0.5 || y1 > float64(bounds.Dy())+0.5 {
+			return image.Rectangle{}, false
+		}
+	}
+
+	region := image.Rect(int(math.Round(x0)), int(math.Round(y0)), int(math.Round(x1)), int(math.Round(y1)))
+	if region.Dx() == 0 {
+		region.Max.X++
+	}
+	if region.Dy() == 0 {
+		region.Max.Y++
+	}
+	region = region.Add(bounds.Min).Intersect(bounds)
+	return region, !region.Empty()
+}
+
+// FocalPoint is a point of interest in an image, given as fractions of the image's dimensions.
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
 type ScalingOptions struct {
 	Crop *CropType
 	Fill *Dimensions
 	Fit  *Dimensions
+
+	// Focus is an alternative to Crop that crops filled images around a focal point.
+	Focus *FocalPoint
+
+	// Rect is a region of the image to extract before it's scaled.
+	Rect *Rectangle
+
+	// Upscale permits raster images to be scaled beyond their original dimensions. By default,
+	// they're only scaled down.
+	Upscale *bool
 }
 
 func (o *ScalingOptions) IsValid() bool {
-	if o.Crop != nil {
-		// o.Crop cannot be provided by itself
+	if o.Crop != nil || o.Focus != nil {
+		// o.Crop and o.Focus cannot be provided by themselves
 		return o.Fill != nil
 	}
 
-	return o.Fill != nil || o.Fit != nil
+	return o.Fill != nil || o.Fit != nil || o.Rect != nil
 }
 
-func ScalingFilter(opts *ScalingOptions) Filter {
-	return func(in *Response) (*Response, *FilterError) {
-		var img image.Image
-		var err error
+// scale applies the scaling options to img. If maxWidth or maxHeight is non-zero, the output is
+// scaled down further to fit within them.
+func (o *ScalingOptions) scale(img image.Image, maxWidth, maxHeight int) image.Image {
+	upscale := o.Upscale != nil && *o.Upscale
+	bounds := img.Bounds()
+
+	switch {
+	case o.Fit != nil:
+		width, height := ScaleToFit(o.Fit.Width, o.Fit.Height)(bounds.Dx(), bounds.Dy(), upscale)
+		width, height = limitDimensions(width, height, maxWidth, maxHeight)
+		return resize(img, width, height)
+	case o.Fill != nil:
 		var crop *imaging.Anchor
+		if o.Crop != nil {
+			if anchor := o.Crop.Anchor(); anchor != nil {
+				crop = anchor
+			}
+		}
 
-		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
-		switch contentType {
-		case "image/svg+xml":
-			return in, nil
-		case "image/jpeg":
-			img, err = jpeg.Decode(in.Body)
-		case "image/png":
-			img, err = png.Decode(in.Body)
-		default:
-			return nil, &FilterError{
-				Error:      fmt.Errorf("unsupported content-type"),
-				StatusCode: http.StatusForbidden,
+		if crop != nil || o.Focus != nil {
+			width, height := o.cropDimensions(bounds, maxWidth, maxHeight)
+			if o.Focus != nil {
+				return fillFocus(img, width, height, o.Focus)
 			}
+			return imaging.Fill(img, width, height, *crop, imaging.CatmullRom)
 		}
 
-		if err != nil {
+		width, height := ScaleToFill(o.Fill.Width, o.Fill.Height)(bounds.Dx(), bounds.Dy(), upscale)
+		width, height = limitDimensions(width, height, maxWidth, maxHeight)
+		return resize(img, width, height)
+	}
+	return img
+}
+
+// cropDimensions returns the dimensions of filled images that are cropped.
+func (o *ScalingOptions) cropDimensions(bounds image.Rectangle, maxWidth, maxHeight int) (int, int) {
+	width := o.Fill.Width
+	height := o.Fill.Height
+
+	if o.Upscale == nil || !*o.Upscale {
+		if bounds.Dx() < width {
+			width = bounds.Dx()
+		}
+		if bounds.Dy() < height {
+			height = bounds.Dy()
+		}
+	}
+	return limitDimensions(width, height, maxWidth, maxHeight)
+}
+
+// fillFocus scales img to fill the given dimensions and crops it to them, keeping the focal point as
+// close to the center of the output as the image's bounds allow.
+func fillFocus(img image.Image, width, height int, focus *FocalPoint) image.Image {
+	bounds := img.Bounds()
+	var scaled *image.NRGBA
+	if float64(bounds.Dx())/float64(bounds.Dy()) < float64(width)/float64(height) {
+		scaled = imaging.Resize(img, width, 0, imaging.CatmullRom)
+	} else {
+		scaled = imaging.Resize(img, 0, height, imaging.CatmullRom)
+	}
+
+	clamp := func(n, max int) int {
+		if n > max {
+			n = max
+		}
+		if n < 0 {
+			n = 0
+		}
+		return n
+	}
+	scaledBounds := scaled.Bounds()
+	x := clamp(int(math.Round(focus.X*float64(scaledBounds.Dx())))-width/2, scaledBounds.Dx()-width)
+	y := clamp(int(math.Round(focus.Y*float64(scaledBounds.Dy())))-height/2, scaledBounds.Dy()-height)
+	return imaging.Crop(scaled, image.Rect(x, y, x+width, y+height))
+}
+
+// resize resizes img to the given dimensions, if they're not already its dimensions.
+func resize(img image.Image, width, height int) image.Image {
+	if bounds := img.Bounds(); bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	return imaging.Resize(img, width, height, imaging.CatmullRom)
+}
+
+// ScalingFilter crops and scales raster images. Every frame of an animated image is scaled.
+func ScalingFilter(opts *ScalingOptions) Filter {
+	return func(in *Response) (*Response, *FilterError) {
+		maxWidth, maxHeight := in.config.maxOutputDimensions()
+		return imageFilter(func(img *Image) (*Image, *FilterError) {
+			if opts.Rect != nil {
+				region, ok := opts.Rect.region(img.Frames[0].Bounds(), img.scale)
+				if !ok {
+					return nil, &FilterError{
+						Error:      fmt.Errorf("rect out of bounds"),
+						StatusCode: http.StatusBadRequest,
+					}
+				}
+				img = img.transform(func(frame image.Image) image.Image {
+					return imaging.Crop(frame, region)
+				})
+			}
+
+			// Smart crops are chosen once, based on the first frame, so that the frames of
+			// animated images stay aligned.
+			frameOpts := opts
+			if opts.Fill != nil && opts.Crop != nil && *opts.Crop == CropTypeSmart {
+				bounds := img.Frames[0].Bounds()
+				width, height := opts.cropDimensions(bounds, maxWidth, maxHeight)
+				smartOpts := *opts
+				smartOpts.Crop = nil
+				smartOpts.Focus = smartFocus(img.Frames[0], width, height)
+				frameOpts = &smartOpts
+			}
+
+			return img.transform(func(frame image.Image) image.Image {
+				return frameOpts.scale(frame, maxWidth, maxHeight)
+			}), nil
+		})(in)
+	}
+}
+
+// FrameFilter extracts a single still frame from an animated GIF. Other images are left untouched
+// unless a frame other than the first is requested.
+func FrameFilter(frame int) Filter {
+	extract := imageFilter(func(img *Image) (*Image, *FilterError) {
+		if frame >= len(img.Frames) {
 			return nil, &FilterError{
-				Error:      fmt.Errorf("unable to decode image"),
+				Error:      fmt.Errorf("frame out of range"),
 				StatusCode: http.StatusBadRequest,
 			}
 		}
+		return &Image{
+			Frames: []image.Image{img.Frames[frame]},
+		}, nil
+	})
 
-		switch {
-		case opts.Fit != nil:
-			img = imaging.Fit(img, opts.Fit.Width, opts.Fit.Height, imaging.CatmullRom)
-		case opts.Fill != nil:
-			if opts.Crop != nil {
-				if anchor := opts.Crop.Anchor(); anchor != nil {
-					crop = anchor
-				}
+	return func(in *Response) (*Response, *FilterError) {
+		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+		if frame == 0 && in.Image == nil && contentType != "image/gif" {
+			return in, nil
+		}
+		return extract(in)
+	}
+}
+
+// RotateFilter rotates raster images clockwise by the given angle in degrees. Angles that aren't
+// multiples of 90 enlarge the image to fit its rotated corners, and the uncovered areas are filled
+// with the background color.
+func RotateFilter(angle float64, background color.Color) Filter {
+	return imageFilter(func(img *Image) (*Image, *FilterError) {
+		return img.transform(func(frame image.Image) image.Image {
+			return imaging.Rotate(frame, -angle, background)
+		}), nil
+	})
+}
+
+// FlipFilter flips raster images horizontally, vertically, or both.
+func FlipFilter(horizontal, vertical bool) Filter {
+	return imageFilter(func(img *Image) (*Image, *FilterError) {
+		return img.transform(func(frame image.Image) image.Image {
+			if horizontal {
+				frame = imaging.FlipH(frame)
 			}
+			if vertical {
+				frame = imaging.FlipV(frame)
+			}
+			return frame
+		}), nil
+	})
+}
 
-			if crop != nil {
-				width := opts.Fill.Width
-				height := opts.Fill.Height
+// OrientationFilter rotates and flips JPEG images as described by their EXIF orientation, which
+// would otherwise be lost when they're encoded again. Upright images aren't decoded.
+func OrientationFilter(in *Response) (*Response, *FilterError) {
+	contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+	if in.Image != nil || contentType != "image/jpeg" {
+		return in, nil
+	}
 
-				if img.Bounds().Dx() < width {
-					width = img.Bounds().Dx()
-				}
-				if img.Bounds().Dy() < height {
-					height = img.Bounds().Dy()
-				}
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, &FilterError{
+			Error:      err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	in = &Response{
+		Header: in.Header,
+		Body:   bytes.NewReader(data),
+		config: in.config,
+		ctx:    in.ctx,
+	}
 
-				img = imaging.Fill(img, width, height, *crop, imaging.CatmullRom)
-			} else {
-				width, height := ScaleToFill(opts.Fill.Width, opts.Fill.Height)(img.Bounds().Dx(), img.Bounds().Dy(), false)
-				img = imaging.Resize(img, width, height, imaging.CatmullRom)
-			}
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		return in, nil
+	}
+	return imageFilter(func(img *Image) (*Image, *FilterError) {
+		return img.transform(func(frame image.Image) image.Image {
+			return orient(frame, orientation)
+		}), nil
+	})(in)
+}
+
+// EncodeFilter encodes the response's image in its content type if no other filter has done so.
+func EncodeFilter(in *Response) (*Response, *FilterError) {
+	if in.Body != nil {
+		return in, nil
+	}
+
+	contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+
+	buf := &bytes.Buffer{}
+	if filterErr := encodeImage(contentType, buf, in.Image, 98); filterErr != nil {
+		return nil, filterErr
+	}
+
+	return encodedResponse(in, contentType, buf, in.Image), nil
+}
+
+func JPEGFilter(quality int) Filter {
+	return func(in *Response) (*Response, *FilterError) {
+		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+		if isVector(in) || (in.Image == nil && contentType == "image/jpeg") {
+			return in, nil
+		}
+
+		img, filterErr := decodeResponse(in)
+		if filterErr != nil {
+			return nil, filterErr
 		}
 
 		buf := &bytes.Buffer{}
+		if filterErr := encodeImage("image/jpeg", buf, img, quality); filterErr != nil {
+			return nil, filterErr
+		}
 
-		switch contentType {
-		case "image/jpeg":
-			err = jpeg.Encode(buf, img, &jpeg.Options{
-				Quality: 98,
-			})
-		case "image/png":
-			err = png.Encode(buf, img)
+		return encodedResponse(in, "image/jpeg", buf, img), nil
+	}
+}
+
+func WebPFilter(quality int, lossless bool) Filter {
+	return func(in *Response) (*Response, *FilterError) {
+		if isVector(in) {
+			return in, nil
+		}
+
+		img, filterErr := decodeResponse(in)
+		if filterErr != nil {
+			return nil, filterErr
 		}
 
+		buf := &bytes.Buffer{}
+
+		err := webp.Encode(buf, img.Frames[0], &webp.Options{
+			Lossless: lossless,
+			Quality:  float32(quality),
+		})
+
 		if err != nil {
 			return nil, &FilterError{
 				Error:      fmt.Errorf("unable to encode image"),
@@ -217,61 +722,129 @@ func ScalingFilter(opts *ScalingOptions) Filter {
 			}
 		}
 
-		return &Response{
-			Header: in.Header,
-			Body:   buf,
-		}, nil
+		return encodedResponse(in, "image/webp", buf, img), nil
 	}
 }
 
-func JPEGFilter(quality int) Filter {
+// PNGFilter converts raster images to PNG. If colors is non-zero, the image is quantized to a
+// palette of at most that many colors.
+func PNGFilter(compression png.CompressionLevel, colors int) Filter {
 	return func(in *Response) (*Response, *FilterError) {
-		var img image.Image
-		var err error
-
-		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
-		switch contentType {
-		case "image/svg+xml", "image/jpeg":
+		if isVector(in) {
 			return in, nil
-		case "image/png":
-			img, err = png.Decode(in.Body)
-		default:
-			return nil, &FilterError{
-				Error:      fmt.Errorf("unsupported content-type"),
-				StatusCode: http.StatusForbidden,
-			}
 		}
 
-		if err != nil {
-			return nil, &FilterError{
-				Error:      fmt.Errorf("unable to decode image"),
-				StatusCode: http.StatusBadRequest,
-			}
+		img, filterErr := decodeResponse(in)
+		if filterErr != nil {
+			return nil, filterErr
 		}
 
-		buf := &bytes.Buffer{}
+		frame := img.Frames[0]
+		if colors > 0 {
+			frame = quantize(frame, colors)
+		}
 
-		err = jpeg.Encode(buf, img, &jpeg.Options{
-			Quality: quality,
-		})
+		buf := &bytes.Buffer{}
 
-		if err != nil {
+		encoder := &png.Encoder{
+			CompressionLevel: compression,
+		}
+		if err := encoder.Encode(buf, frame); err != nil {
 			return nil, &FilterError{
 				Error:      fmt.Errorf("unable to encode image"),
 				StatusCode: http.StatusBadRequest,
 			}
 		}
 
-		out := &Response{
-			Header: make(http.Header),
-			Body:   buf,
+		return encodedResponse(in, "image/png", buf, img), nil
+	}
+}
+
+// AutoFormatFilter picks the output format based on the client's Accept header. WebP is preferred if
+// the client explicitly accepts it. Otherwise, images with transparency are converted to PNG and
+// everything else is converted to JPEG. Animated GIFs and vector images are left untouched.
+func AutoFormatFilter(accept string, quality int) Filter {
+	webpAccepted := acceptsMediaType(accept, "image/webp")
+
+	return func(in *Response) (*Response, *FilterError) {
+		if isVector(in) {
+			return in, nil
 		}
 
-		for k, v := range in.Header {
-			out.Header[k] = v
+		contentType, _, _ := mime.ParseMediaType(in.Header.Get("Content-Type"))
+
+		if in.Image == nil && contentType == "image/jpeg" && !webpAccepted {
+			out := encodedResponse(in, contentType, in.Body, nil)
+			out.Header.Set("Vary", "Accept")
+			return out, nil
+		}
+
+		// If the image hasn't been decoded yet, hold on to the original body in case the chosen
+		// format turns out to be the one we already have.
+		var original []byte
+		if in.Image == nil {
+			data, err := ioutil.ReadAll(in.Body)
+			if err != nil {
+				return nil, &FilterError{
+					Error:      err,
+					StatusCode: http.StatusInternalServerError,
+				}
+			}
+			original = data
+			in = &Response{
+				Header: in.Header,
+				Body:   bytes.NewReader(data),
+				config: in.config,
+				ctx:    in.ctx,
+			}
 		}
-		out.Header.Set("Content-Type", "image/jpeg")
+
+		img, filterErr := decodeResponse(in)
+		if filterErr != nil {
+			return nil, filterErr
+		}
+
+		outputType := "image/jpeg"
+		switch {
+		case len(img.Frames) > 1:
+			outputType = "image/gif"
+		case webpAccepted:
+			outputType = "image/webp"
+		case !isOpaque(img.Frames[0]):
+			outputType = "image/png"
+		}
+
+		var out *Response
+		if outputType == contentType && original != nil {
+			out = encodedResponse(in, outputType, bytes.NewReader(original), img)
+		} else {
+			buf := &bytes.Buffer{}
+			if filterErr := encodeImage(outputType, buf, img, quality); filterErr != nil {
+				return nil, filterErr
+			}
+			out = encodedResponse(in, outputType, buf, img)
+		}
+		out.Header.Set("Vary", "Accept")
 
 		return out, nil
 	}
 }
+
+// isOpaque reports whether every pixel of img is fully opaque.
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -2,14 +2,22 @@ package proxy
 
 import (
 	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
+	"github.com/chai2010/webp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 func getImage(name string) []byte {
@@ -30,8 +38,53 @@ func getResponse(imageName string) *Response {
 	}
 }
 
+// getResponseAs returns a response containing the given test image, transcoded to contentType.
+func getResponseAs(imageName, contentType string) *Response {
+	img, err := png.Decode(bytes.NewReader(getImage(imageName)))
+	if err != nil {
+		panic(err)
+	}
+
+	buf := &bytes.Buffer{}
+	switch contentType {
+	case "image/bmp":
+		err = bmp.Encode(buf, img)
+	case "image/gif":
+		err = gif.Encode(buf, img, nil)
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/tiff":
+		err = tiff.Encode(buf, img, nil)
+	case "image/webp":
+		err = webp.Encode(buf, img, &webp.Options{
+			Lossless: true,
+		})
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	return &Response{
+		Header: http.Header{
+			"Content-Type": []string{contentType},
+		},
+		Body: buf,
+	}
+}
+
+var sourceContentTypes = []string{"image/bmp", "image/gif", "image/jpeg", "image/png", "image/tiff", "image/webp"}
+
+// encodeResponse runs EncodeFilter on resp so that its body can be inspected.
+func encodeResponse(t *testing.T, resp *Response) *Response {
+	resp, err := EncodeFilter(resp)
+	require.Nil(t, err)
+	return resp
+}
+
 func assertResponseImageSize(t *testing.T, resp *Response, expectedWidth, expectedHeight int) {
-	img, err := png.Decode(resp.Body)
+	img, err := png.Decode(encodeResponse(t, resp).Body)
 	require.NoError(t, err)
 	assert.EqualValues(t, expectedWidth, img.Bounds().Dx())
 	assert.EqualValues(t, expectedHeight, img.Bounds().Dy())
@@ -97,6 +150,354 @@ func TestScalingFilter(t *testing.T) {
 	})
 }
 
+func TestScalingFilter_Upscale(t *testing.T) {
+	upscale := true
+	cropType := CropTypeCenter
+
+	for name, tc := range map[string]struct {
+		Options        *ScalingOptions
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		"Fit": {
+			Options:        &ScalingOptions{Fit: &Dimensions{100, 200}, Upscale: &upscale},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+		"Fill": {
+			Options:        &ScalingOptions{Fill: &Dimensions{100, 200}, Upscale: &upscale},
+			ExpectedWidth:  200,
+			ExpectedHeight: 200,
+		},
+		"FillCropped": {
+			Options:        &ScalingOptions{Fill: &Dimensions{100, 200}, Crop: &cropType, Upscale: &upscale},
+			ExpectedWidth:  100,
+			ExpectedHeight: 200,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testScalingFilter(t, ScalingFilter(tc.Options), "50x50.png", tc.ExpectedWidth, tc.ExpectedHeight)
+		})
+	}
+}
+
+func TestScalingFilter_MaxOutputDimensions(t *testing.T) {
+	upscale := true
+	config := &Configuration{
+		MaxOutputWidth:  150,
+		MaxOutputHeight: 100,
+	}
+
+	for name, tc := range map[string]struct {
+		Options        *ScalingOptions
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		"Fit": {
+			Options:        &ScalingOptions{Fit: &Dimensions{1000, 1000}, Upscale: &upscale},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+		"Fill": {
+			Options:        &ScalingOptions{Fill: &Dimensions{300, 100}},
+			ExpectedWidth:  100,
+			ExpectedHeight: 100,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			in := getResponse("200x200.png")
+			in.config = config
+			resp, err := ScalingFilter(tc.Options)(in)
+			require.Nil(t, err)
+			assertResponseImageSize(t, resp, tc.ExpectedWidth, tc.ExpectedHeight)
+		})
+	}
+}
+
+func TestContentTypeFilter(t *testing.T) {
+	for _, contentType := range append(sourceContentTypes, "image/svg+xml") {
+		t.Run(contentType, func(t *testing.T) {
+			in := &Response{
+				Header: http.Header{
+					"Content-Type": []string{contentType},
+				},
+				Body: &bytes.Buffer{},
+			}
+			out, err := ContentTypeFilter(in)
+			require.Nil(t, err)
+			assert.Equal(t, contentType, out.Header.Get("Content-Type"))
+		})
+	}
+
+	for _, contentType := range []string{"text/html", "image/x-icon", ""} {
+		t.Run("Forbidden"+contentType, func(t *testing.T) {
+			in := &Response{
+				Header: http.Header{
+					"Content-Type": []string{contentType},
+				},
+				Body: &bytes.Buffer{},
+			}
+			_, err := ContentTypeFilter(in)
+			require.NotNil(t, err)
+			assert.Equal(t, http.StatusForbidden, err.StatusCode)
+		})
+	}
+}
+
+func TestScalingFilter_SourceFormats(t *testing.T) {
+	filter := ScalingFilter(&ScalingOptions{
+		Fit: &Dimensions{100, 100},
+	})
+	for _, contentType := range sourceContentTypes {
+		t.Run(contentType, func(t *testing.T) {
+			out, filterErr := filter(getResponseAs("200x100.png", contentType))
+			require.Nil(t, filterErr)
+			assert.Equal(t, contentType, out.Header.Get("Content-Type"))
+			out, filterErr = JPEGFilter(98)(out)
+			require.Nil(t, filterErr)
+			img, err := jpeg.Decode(out.Body)
+			require.NoError(t, err)
+			assert.Equal(t, 100, img.Bounds().Dx())
+			assert.Equal(t, 50, img.Bounds().Dy())
+		})
+	}
+}
+
+// getAnimatedGIFResponse returns a response containing a 200x100 animated GIF. Each frame is a
+// solid color. The second frame only covers the left half of the canvas.
+func getAnimatedGIFResponse() *Response {
+	palette := color.Palette{
+		color.RGBA{0xff, 0x00, 0x00, 0xff},
+		color.RGBA{0x00, 0xff, 0x00, 0xff},
+		color.RGBA{0x00, 0x00, 0xff, 0xff},
+	}
+	g := &gif.GIF{
+		LoopCount: 3,
+	}
+	for i, bounds := range []image.Rectangle{
+		image.Rect(0, 0, 200, 100),
+		image.Rect(0, 0, 100, 100),
+		image.Rect(0, 0, 200, 100),
+	} {
+		frame := image.NewPaletted(bounds, palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i)
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		panic(err)
+	}
+	return &Response{
+		Header: http.Header{
+			"Content-Type": []string{"image/gif"},
+		},
+		Body: buf,
+	}
+}
+
+func assertColor(t *testing.T, expected color.Color, actual color.Color) {
+	r1, g1, b1, a1 := expected.RGBA()
+	r2, g2, b2, a2 := actual.RGBA()
+	assert.Equal(t, []uint32{r1 >> 8, g1 >> 8, b1 >> 8, a1 >> 8}, []uint32{r2 >> 8, g2 >> 8, b2 >> 8, a2 >> 8})
+}
+
+func TestScalingFilter_AnimatedGIF(t *testing.T) {
+	cropType := CropTypeCenter
+	for name, tc := range map[string]struct {
+		Options        *ScalingOptions
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		"Fit": {
+			Options:        &ScalingOptions{Fit: &Dimensions{100, 100}},
+			ExpectedWidth:  100,
+			ExpectedHeight: 50,
+		},
+		"Fill": {
+			Options:        &ScalingOptions{Fill: &Dimensions{50, 50}},
+			ExpectedWidth:  100,
+			ExpectedHeight: 50,
+		},
+		"Crop": {
+			Options:        &ScalingOptions{Fill: &Dimensions{50, 50}, Crop: &cropType},
+			ExpectedWidth:  50,
+			ExpectedHeight: 50,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, filterErr := ScalingFilter(tc.Options)(getAnimatedGIFResponse())
+			require.Nil(t, filterErr)
+			assert.Equal(t, "image/gif", out.Header.Get("Content-Type"))
+
+			g, err := gif.DecodeAll(encodeResponse(t, out).Body)
+			require.NoError(t, err)
+			assert.Equal(t, 3, g.LoopCount)
+			assert.Equal(t, []int{10, 20, 30}, g.Delay)
+			require.Len(t, g.Image, 3)
+			for _, frame := range g.Image {
+				assert.Equal(t, tc.ExpectedWidth, frame.Bounds().Dx())
+				assert.Equal(t, tc.ExpectedHeight, frame.Bounds().Dy())
+			}
+
+			// The second frame only covered the left half of the canvas, so the right half should
+			// still show the first frame.
+			second := g.Image[1]
+			assertColor(t, color.RGBA{0x00, 0xff, 0x00, 0xff}, second.At(0, 0))
+			assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, second.At(second.Bounds().Max.X-1, 0))
+		})
+	}
+}
+
+func TestFrameFilter(t *testing.T) {
+	t.Run("AnimatedGIF", func(t *testing.T) {
+		out, filterErr := FrameFilter(1)(getAnimatedGIFResponse())
+		require.Nil(t, filterErr)
+		g, err := gif.DecodeAll(encodeResponse(t, out).Body)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 1)
+		assert.Equal(t, 200, g.Image[0].Bounds().Dx())
+		assert.Equal(t, 100, g.Image[0].Bounds().Dy())
+		assertColor(t, color.RGBA{0x00, 0xff, 0x00, 0xff}, g.Image[0].At(0, 0))
+		assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, g.Image[0].At(199, 0))
+	})
+
+	t.Run("OutOfRange", func(t *testing.T) {
+		_, filterErr := FrameFilter(3)(getAnimatedGIFResponse())
+		require.NotNil(t, filterErr)
+		assert.Equal(t, http.StatusBadRequest, filterErr.StatusCode)
+	})
+
+	t.Run("Still", func(t *testing.T) {
+		in := getResponse("50x50.png")
+		out, filterErr := FrameFilter(0)(in)
+		require.Nil(t, filterErr)
+		assert.Equal(t, in, out)
+	})
+}
+
+func TestPNGFilter(t *testing.T) {
+	t.Run("JPEG", func(t *testing.T) {
+		out, filterErr := PNGFilter(png.BestCompression, 0)(getResponseAs("200x100.png", "image/jpeg"))
+		require.Nil(t, filterErr)
+		assert.Equal(t, "image/png", out.Header.Get("Content-Type"))
+		assertResponseImageSize(t, out, 200, 100)
+	})
+
+	t.Run("Palette", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), 0x80, uint8(x * 4)})
+			}
+		}
+		buf := &bytes.Buffer{}
+		require.NoError(t, png.Encode(buf, img))
+		in := &Response{
+			Header: http.Header{
+				"Content-Type": []string{"image/png"},
+			},
+			Body: buf,
+		}
+
+		out, filterErr := PNGFilter(png.DefaultCompression, 16)(in)
+		require.Nil(t, filterErr)
+		result, err := png.Decode(out.Body)
+		require.NoError(t, err)
+		paletted, ok := result.(*image.Paletted)
+		require.True(t, ok)
+		assert.True(t, len(paletted.Palette) <= 16)
+		assert.False(t, paletted.Opaque())
+	})
+}
+
+func TestAutoFormatFilter(t *testing.T) {
+	transparent := func() *Response {
+		img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		buf := &bytes.Buffer{}
+		require.NoError(t, png.Encode(buf, img))
+		return &Response{
+			Header: http.Header{
+				"Content-Type": []string{"image/png"},
+			},
+			Body: buf,
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		Accept              string
+		Response            func() *Response
+		ExpectedContentType string
+	}{
+		"WebP": {
+			Accept:              "image/webp,*/*",
+			Response:            func() *Response { return getResponseAs("50x50.png", "image/jpeg") },
+			ExpectedContentType: "image/webp",
+		},
+		"OpaquePNG": {
+			Accept:              "*/*",
+			Response:            func() *Response { return getResponseAs("50x50.png", "image/png") },
+			ExpectedContentType: "image/jpeg",
+		},
+		"TransparentPNG": {
+			Accept:              "*/*",
+			Response:            transparent,
+			ExpectedContentType: "image/png",
+		},
+		"JPEG": {
+			Accept:              "",
+			Response:            func() *Response { return getResponseAs("50x50.png", "image/jpeg") },
+			ExpectedContentType: "image/jpeg",
+		},
+		"AnimatedGIF": {
+			Accept:              "image/webp",
+			Response:            getAnimatedGIFResponse,
+			ExpectedContentType: "image/gif",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, filterErr := AutoFormatFilter(tc.Accept, 90)(tc.Response())
+			require.Nil(t, filterErr)
+			assert.Equal(t, tc.ExpectedContentType, out.Header.Get("Content-Type"))
+			assert.Equal(t, "Accept", out.Header.Get("Vary"))
+
+			_, format, err := image.Decode(out.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "image/"+format, tc.ExpectedContentType)
+		})
+	}
+}
+
+func TestEncodeFilter(t *testing.T) {
+	t.Run("Untouched", func(t *testing.T) {
+		in := getResponse("50x50.png")
+		out, err := EncodeFilter(in)
+		require.Nil(t, err)
+		assert.Equal(t, in, out)
+	})
+
+	t.Run("Decoded", func(t *testing.T) {
+		in, err := ScalingFilter(&ScalingOptions{
+			Fit: &Dimensions{100, 100},
+		})(getResponseAs("200x100.png", "image/jpeg"))
+		require.Nil(t, err)
+		assert.Nil(t, in.Body)
+		require.NotNil(t, in.Image)
+
+		out, err := EncodeFilter(in)
+		require.Nil(t, err)
+		assert.Equal(t, "image/jpeg", out.Header.Get("Content-Type"))
+		img, decodeErr := jpeg.Decode(out.Body)
+		require.NoError(t, decodeErr)
+		assert.Equal(t, 100, img.Bounds().Dx())
+		assert.Equal(t, 50, img.Bounds().Dy())
+	})
+}
+
 func TestJPEGFilter(t *testing.T) {
 	in := getResponse("50x50.png")
 	out, filterErr := JPEGFilter(98)(in)
@@ -105,3 +506,312 @@ func TestJPEGFilter(t *testing.T) {
 	_, err := jpeg.Decode(out.Body)
 	require.NoError(t, err)
 }
+
+func TestWebPFilter(t *testing.T) {
+	t.Run("Lossy", func(t *testing.T) {
+		in := getResponse("50x50.png")
+		out, filterErr := WebPFilter(80, false)(in)
+		require.Nil(t, filterErr)
+		assert.Equal(t, "image/webp", out.Header.Get("Content-Type"))
+		img, err := webp.Decode(out.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 50, img.Bounds().Dx())
+		assert.Equal(t, 50, img.Bounds().Dy())
+	})
+
+	t.Run("Lossless", func(t *testing.T) {
+		src, err := png.Decode(bytes.NewReader(getImage("50x50.png")))
+		require.NoError(t, err)
+
+		in := getResponse("50x50.png")
+		out, filterErr := WebPFilter(98, true)(in)
+		require.Nil(t, filterErr)
+		assert.Equal(t, "image/webp", out.Header.Get("Content-Type"))
+		img, err := webp.Decode(out.Body)
+		require.NoError(t, err)
+
+		for y := src.Bounds().Min.Y; y < src.Bounds().Max.Y; y++ {
+			for x := src.Bounds().Min.X; x < src.Bounds().Max.X; x++ {
+				r1, g1, b1, a1 := src.At(x, y).RGBA()
+				r2, g2, b2, a2 := img.At(x, y).RGBA()
+				require.Equal(t, []uint32{r1, g1, b1, a1}, []uint32{r2, g2, b2, a2})
+			}
+		}
+	})
+
+	t.Run("JPEG", func(t *testing.T) {
+		src, err := png.Decode(bytes.NewReader(getImage("200x100.png")))
+		require.NoError(t, err)
+		buf := &bytes.Buffer{}
+		require.NoError(t, jpeg.Encode(buf, src, nil))
+
+		in := &Response{
+			Header: http.Header{
+				"Content-Type": []string{"image/jpeg"},
+			},
+			Body: buf,
+		}
+		out, filterErr := WebPFilter(80, false)(in)
+		require.Nil(t, filterErr)
+		assert.Equal(t, "image/webp", out.Header.Get("Content-Type"))
+		img, err := webp.Decode(out.Body)
+		require.NoError(t, err)
+		assert.Equal(t, 200, img.Bounds().Dx())
+		assert.Equal(t, 100, img.Bounds().Dy())
+	})
+
+	t.Run("SVG", func(t *testing.T) {
+		in := &Response{
+			Header: http.Header{
+				"Content-Type": []string{"image/svg+xml"},
+			},
+			Body: &bytes.Buffer{},
+		}
+		out, filterErr := WebPFilter(80, false)(in)
+		require.Nil(t, filterErr)
+		assert.Equal(t, "image/svg+xml", out.Header.Get("Content-Type"))
+	})
+}
+
+func TestDecodeImage_MaxPixels(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Response  *Response
+		MaxPixels int64
+		Error     bool
+	}{
+		"Within": {
+			Response:  getResponse("50x50.png"),
+			MaxPixels: 50 * 50,
+		},
+		"Exceeds": {
+			Response:  getResponse("50x50.png"),
+			MaxPixels: 50*50 - 1,
+			Error:     true,
+		},
+		"AnimatedWithin": {
+			Response:  getAnimatedGIFResponse(),
+			MaxPixels: 3 * 200 * 100,
+		},
+		"AnimatedExceeds": {
+			Response:  getAnimatedGIFResponse(),
+			MaxPixels: 3*200*100 - 1,
+			Error:     true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := decodeImage(tc.Response.Header.Get("Content-Type"), tc.Response.Body, tc.MaxPixels)
+			if tc.Error {
+				require.NotNil(t, err)
+				assert.Equal(t, http.StatusRequestEntityTooLarge, err.StatusCode)
+			} else {
+				require.Nil(t, err)
+				assert.NotEmpty(t, img.Frames)
+			}
+		})
+	}
+}
+
+func TestRotateFilter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Angle          float64
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		"90": {
+			Angle:          90,
+			ExpectedWidth:  100,
+			ExpectedHeight: 200,
+		},
+		"180": {
+			Angle:          180,
+			ExpectedWidth:  200,
+			ExpectedHeight: 100,
+		},
+		"45": {
+			Angle:          45,
+			ExpectedWidth:  212,
+			ExpectedHeight: 212,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testScalingFilter(t, RotateFilter(tc.Angle, color.White), "200x100.png", tc.ExpectedWidth, tc.ExpectedHeight)
+		})
+	}
+
+	t.Run("Clockwise", func(t *testing.T) {
+		out, filterErr := RotateFilter(90, color.White)(getAnimatedGIFResponse())
+		require.Nil(t, filterErr)
+		second := out.Image.Frames[1]
+		assertColor(t, color.RGBA{0x00, 0xff, 0x00, 0xff}, second.At(second.Bounds().Max.X-1, 0))
+		assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, second.At(second.Bounds().Max.X-1, second.Bounds().Max.Y-1))
+	})
+
+	t.Run("Background", func(t *testing.T) {
+		out, filterErr := RotateFilter(45, color.RGBA{0x00, 0x00, 0xff, 0xff})(getResponse("200x100.png"))
+		require.Nil(t, filterErr)
+		assertColor(t, color.RGBA{0x00, 0x00, 0xff, 0xff}, out.Image.Frames[0].At(0, 0))
+	})
+}
+
+func TestFlipFilter(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Horizontal bool
+		Vertical   bool
+		Red        image.Point
+	}{
+		"Horizontal": {
+			Horizontal: true,
+			Red:        image.Pt(1, 0),
+		},
+		"Vertical": {
+			Vertical: true,
+			Red:      image.Pt(0, 1),
+		},
+		"Both": {
+			Horizontal: true,
+			Vertical:   true,
+			Red:        image.Pt(1, 1),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+			draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+			img.Set(0, 0, color.RGBA{0xff, 0x00, 0x00, 0xff})
+
+			out, filterErr := FlipFilter(tc.Horizontal, tc.Vertical)(&Response{
+				Header: http.Header{
+					"Content-Type": []string{"image/png"},
+				},
+				Image: &Image{
+					Frames: []image.Image{img},
+				},
+			})
+			require.Nil(t, filterErr)
+			assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, out.Image.Frames[0].At(tc.Red.X, tc.Red.Y))
+		})
+	}
+}
+
+func TestScalingFilter_Rect(t *testing.T) {
+	cropType := CropTypeCenter
+
+	for name, tc := range map[string]struct {
+		Options        *ScalingOptions
+		ExpectedWidth  int
+		ExpectedHeight int
+	}{
+		"Pixels": {
+			Options:        &ScalingOptions{Rect: &Rectangle{X: 50, Y: 20, Width: 100, Height: 60}},
+			ExpectedWidth:  100,
+			ExpectedHeight: 60,
+		},
+		"Relative": {
+			Options:        &ScalingOptions{Rect: &Rectangle{X: 0.5, Y: 0, Width: 0.5, Height: 0.5, Relative: true}},
+			ExpectedWidth:  100,
+			ExpectedHeight: 50,
+		},
+		"Fit": {
+			Options:        &ScalingOptions{Rect: &Rectangle{X: 0, Y: 0, Width: 100, Height: 100}, Fit: &Dimensions{50, 20}},
+			ExpectedWidth:  20,
+			ExpectedHeight: 20,
+		},
+		"FillCropped": {
+			Options:        &ScalingOptions{Rect: &Rectangle{X: 0, Y: 0, Width: 100, Height: 100}, Fill: &Dimensions{50, 20}, Crop: &cropType},
+			ExpectedWidth:  50,
+			ExpectedHeight: 20,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			testScalingFilter(t, ScalingFilter(tc.Options), "200x100.png", tc.ExpectedWidth, tc.ExpectedHeight)
+		})
+	}
+
+	t.Run("OutOfBounds", func(t *testing.T) {
+		for _, rect := range []Rectangle{
+			{X: 150, Y: 0, Width: 100, Height: 100},
+			{X: 0, Y: 0, Width: 200, Height: 101},
+		} {
+			_, filterErr := ScalingFilter(&ScalingOptions{Rect: &rect})(getResponse("200x100.png"))
+			require.NotNil(t, filterErr)
+			assert.Equal(t, http.StatusBadRequest, filterErr.StatusCode)
+		}
+	})
+
+	t.Run("AnimatedGIF", func(t *testing.T) {
+		out, filterErr := ScalingFilter(&ScalingOptions{Rect: &Rectangle{X: 100, Y: 0, Width: 100, Height: 100}})(getAnimatedGIFResponse())
+		require.Nil(t, filterErr)
+		require.Len(t, out.Image.Frames, 3)
+		second := out.Image.Frames[1]
+		assert.Equal(t, 100, second.Bounds().Dx())
+		assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, second.At(0, 0))
+	})
+
+	t.Run("Rasterized", func(t *testing.T) {
+		// Pixels refer to the vector image, which was rasterized at twice its size.
+		out, filterErr := ScalingFilter(&ScalingOptions{Rect: &Rectangle{X: 50, Y: 0, Width: 50, Height: 50}})(&Response{
+			Header: http.Header{
+				"Content-Type": []string{"image/png"},
+			},
+			Image: &Image{
+				Frames: []image.Image{image.NewRGBA(image.Rect(0, 0, 200, 100))},
+				scale:  2,
+			},
+		})
+		require.Nil(t, filterErr)
+		assert.Equal(t, image.Rect(0, 0, 100, 100), out.Image.Frames[0].Bounds())
+	})
+}
+
+func TestScalingFilter_Focus(t *testing.T) {
+	// The subject is a red square, left of the image's center.
+	img := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(146, 46, 154, 54), image.NewUniform(color.RGBA{0xff, 0x00, 0x00, 0xff}), image.Point{}, draw.Src)
+	red := color.RGBA{0xff, 0x00, 0x00, 0xff}
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+
+	cropType := CropTypeCenter
+
+	for name, tc := range map[string]struct {
+		Options  *ScalingOptions
+		Expected map[image.Point]color.Color
+	}{
+		"Centered": {
+			Options: &ScalingOptions{Fill: &Dimensions{50, 50}, Focus: &FocalPoint{0.375, 0.5}},
+			Expected: map[image.Point]color.Color{
+				image.Pt(25, 25): red,
+				image.Pt(0, 25):  white,
+			},
+		},
+		"Clamped": {
+			Options: &ScalingOptions{Fill: &Dimensions{50, 50}, Focus: &FocalPoint{0, 0}},
+			Expected: map[image.Point]color.Color{
+				image.Pt(0, 0):   white,
+				image.Pt(25, 25): white,
+			},
+		},
+		"Anchor": {
+			Options: &ScalingOptions{Fill: &Dimensions{50, 50}, Crop: &cropType},
+			Expected: map[image.Point]color.Color{
+				image.Pt(25, 25): white,
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, filterErr := ScalingFilter(tc.Options)(&Response{
+				Header: http.Header{
+					"Content-Type": []string{"image/png"},
+				},
+				Image: &Image{
+					Frames: []image.Image{img},
+				},
+			})
+			require.Nil(t, filterErr)
+			frame := out.Image.Frames[0]
+			assert.Equal(t, image.Rect(0, 0, 50, 50), frame.Bounds())
+			for point, expected := range tc.Expected {
+				assertColor(t, expected, frame.At(point.X, point.Y))
+			}
+		})
+	}
+}
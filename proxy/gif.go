@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// coalesceGIF renders each frame of g onto a full-size canvas, honoring the frames' disposal
+// methods, so that every frame can be transformed independently of the others.
+func coalesceGIF(g *gif.GIF) []image.Image {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() && len(g.Image) > 0 {
+		bounds = g.Image[0].Bounds()
+	}
+
+	canvas := image.NewNRGBA(bounds)
+	frames := make([]image.Image, 0, len(g.Image))
+
+	for i, frame := range g.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewNRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		rendered := image.NewNRGBA(bounds)
+		draw.Draw(rendered, bounds, canvas, bounds.Min, draw.Src)
+		frames = append(frames, rendered)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// gifFrame converts img to a paletted image suitable for GIF encoding. GIF only supports binary
+// transparency, so pixels that are less than half opaque become fully transparent and the rest
+// become fully opaque.
+func gifFrame(img image.Image) *image.Paletted {
+	bounds := img.Bounds()
+	flattened := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A < 0x80 {
+				c = color.NRGBA{}
+			} else {
+				c.A = 0xff
+			}
+			flattened.SetNRGBA(x, y, c)
+		}
+	}
+	return quantize(flattened, 256)
+}
+
+// encodeAnimatedGIF re-encodes the frames of an animated image, keeping its timing.
+func encodeAnimatedGIF(img *Image) *gif.GIF {
+	out := &gif.GIF{
+		LoopCount: img.LoopCount,
+	}
+	for i, frame := range img.Frames {
+		out.Image = append(out.Image, gifFrame(frame))
+		if i < len(img.Delays) {
+			out.Delay = append(out.Delay, img.Delays[i])
+		} else {
+			out.Delay = append(out.Delay, 0)
+		}
+		// Every frame is a complete rendering of the canvas, so each one is cleared before the next
+		// is drawn.
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	return out
+}
+
+// gifFrameCount counts the frames of a GIF by walking its block structure, without decompressing
+// any image data.
+func gifFrameCount(data []byte) (int, error) {
+	malformed := fmt.Errorf("malformed gif")
+
+	if len(data) < 13 {
+		return 0, malformed
+	}
+	p := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		p += 3 << (flags&0x07 + 1)
+	}
+
+	skipSubBlocks := func(p int) int {
+		for p < len(data) {
+			n := int(data[p])
+			p++
+			if n == 0 {
+				break
+			}
+			p += n
+		}
+		return p
+	}
+
+	frames := 0
+	for p < len(data) {
+		switch data[p] {
+		case 0x21: // extension
+			p = skipSubBlocks(p + 2)
+		case 0x2c: // image descriptor
+			if p+10 > len(data) {
+				return 0, malformed
+			}
+			flags := data[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (flags&0x07 + 1)
+			}
+			// Skip the LZW minimum code size, then the image data.
+			p = skipSubBlocks(p + 1)
+			frames++
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, malformed
+		}
+	}
+	return frames, nil
+}
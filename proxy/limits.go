@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net/http"
+)
+
+// Default resource limits, used when the corresponding Configuration field is zero. Vector images
+// can be rasterized to the largest output by default.
+const (
+	DefaultMaxOriginBytes  = 32 << 20
+	DefaultMaxSourcePixels = 40000000
+	DefaultMaxSVGPixels    = DefaultMaxOutputWidth * DefaultMaxOutputHeight
+	DefaultMaxOutputWidth  = 4096
+	DefaultMaxOutputHeight = 4096
+)
+
+// statusTooLarge is the status code for images that exceed a limit.
+const statusTooLarge = http.StatusRequestEntityTooLarge
+
+// limit resolves a configured limit. Zero selects the default, and a negative value disables the
+// limit, which is returned as zero.
+func limit(value, defaultValue int64) int64 {
+	switch {
+	case value == 0:
+		return defaultValue
+	case value < 0:
+		return 0
+	}
+	return value
+}
+
+// maxOriginBytes returns the maximum size of an origin response body, or zero for no limit.
+func (c *Configuration) maxOriginBytes() int64 {
+	if c == nil {
+		return 0
+	}
+	return limit(c.MaxOriginBytes, DefaultMaxOriginBytes)
+}
+
+// maxSourcePixels returns the maximum number of pixels that may be decoded from an origin image,
+// or zero for no limit.
+func (c *Configuration) maxSourcePixels() int64 {
+	if c == nil {
+		return 0
+	}
+	return limit(c.MaxSourcePixels, DefaultMaxSourcePixels)
+}
+
+// maxSVGPixels returns the maximum number of pixels of the surface vector images are rendered to,
+// or zero for no limit.
+func (c *Configuration) maxSVGPixels() int64 {
+	if c == nil {
+		return 0
+	}
+	return limit(c.MaxSVGPixels, DefaultMaxSVGPixels)
+}
+
+// maxOutputDimensions returns the maximum dimensions of scaled and rasterized images. Zero
+// dimensions are unlimited.
+func (c *Configuration) maxOutputDimensions() (int, int) {
+	if c == nil {
+		return 0, 0
+	}
+	return int(limit(c.MaxOutputWidth, DefaultMaxOutputWidth)), int(limit(c.MaxOutputHeight, DefaultMaxOutputHeight))
+}
+
+// limitDimensions scales width and height down, preserving the aspect ratio, until they fit within
+// maxWidth and maxHeight. Zero maximums are unlimited.
+func limitDimensions(width, height, maxWidth, maxHeight int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return width, height
+	}
+	if maxWidth <= 0 {
+		maxWidth = width
+	}
+	if maxHeight <= 0 {
+		maxHeight = height
+	}
+	return ScaleToFit(maxWidth, maxHeight)(width, height, false)
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewLogger creates a logger that writes JSON to stderr, as used for Configuration.Logger.
+func NewLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Formatter = &logrus.JSONFormatter{}
+	return logger
+}
+
+// statusRecorder records the status code and size of the response written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+func (r *statusRecorder) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+	return r.statusCode
+}
+
+// requestLog collects the details of a proxy request for its log entry.
+type requestLog struct {
+	start time.Time
+
+	// cache describes where the response came from: "memory" or "disk" for cache hits,
+	// "revalidated" for stale cache entries refreshed by the origin, "coalesced" for responses
+	// shared with a concurrent request, or "miss".
+	cache string
+
+	sourceBytes    int
+	sourceWidth    int
+	sourceHeight   int
+	originDuration time.Duration
+	filterDuration time.Duration
+	err            error
+}
+
+// imageDimensions returns the dimensions of an encoded image, or zeros if they can't be determined.
+func imageDimensions(header http.Header, body []byte) (int, int) {
+	contentType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	decodeConfig, ok := configDecoders[contentType]
+	if !ok {
+		return 0, 0
+	}
+	config, err := decodeConfig(bytes.NewReader(body))
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// logRequest writes the log entry for a proxy request. Server errors are logged at the error level
+// and everything else at the info level.
+func (c *Configuration) logRequest(r *Request, recorder *statusRecorder, result *result, l *requestLog) {
+	if c == nil || c.Logger == nil {
+		return
+	}
+
+	fields := logrus.Fields{
+		"origin_host":    r.OriginURL.Host,
+		"origin_path":    r.OriginURL.Path,
+		"transformation": r.transformation,
+		"status":         recorder.status(),
+		"output_bytes":   recorder.bytes,
+		"duration":       time.Since(l.start).Seconds(),
+	}
+	if l.cache != "" {
+		fields["cache"] = l.cache
+	}
+	if l.sourceBytes > 0 {
+		fields["source_bytes"] = l.sourceBytes
+		fields["origin_duration"] = l.originDuration.Seconds()
+	}
+	if l.sourceWidth > 0 {
+		fields["source_width"] = l.sourceWidth
+		fields["source_height"] = l.sourceHeight
+	}
+	if l.filterDuration > 0 {
+		fields["filter_duration"] = l.filterDuration.Seconds()
+	}
+	if result != nil && len(result.Body) > 0 {
+		if width, height := imageDimensions(result.Header, result.Body); width > 0 {
+			fields["output_width"] = width
+			fields["output_height"] = height
+		}
+	}
+
+	entry := c.Logger.WithFields(fields)
+	if l.err != nil {
+		entry = entry.WithError(l.err)
+	}
+	if recorder.status() >= 500 {
+		entry.Error("request failed")
+	} else {
+		entry.Info("request")
+	}
+}
+
+// logInvalidRequest writes the log entry for a request that NewRequest refused.
+func (c *Configuration) logInvalidRequest(path string, err error) {
+	if c == nil || c.Logger == nil {
+		return
+	}
+	c.Logger.WithFields(logrus.Fields{
+		"path":   path,
+		"status": http.StatusBadRequest,
+	}).WithError(err).Info("invalid request")
+}
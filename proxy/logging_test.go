@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Logging(t *testing.T) {
+	image := serveTestImage("200x100.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+	buf := &bytes.Buffer{}
+	config.Logger = NewLogger()
+	config.Logger.Out = buf
+
+	logEntry := func() map[string]interface{} {
+		entry := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(buf).Decode(&entry))
+		return entry
+	}
+
+	proxyTestRequest(t, config, server, "/foo.png?fit=100x100&utm_source=foo", nil)
+	entry := logEntry()
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "/foo.png", entry["origin_path"])
+	assert.Equal(t, "fit=100x100", entry["transformation"])
+	assert.Equal(t, "miss", entry["cache"])
+	assert.EqualValues(t, http.StatusOK, entry["status"])
+	assert.EqualValues(t, 200, entry["source_width"])
+	assert.EqualValues(t, 100, entry["source_height"])
+	assert.EqualValues(t, 100, entry["output_width"])
+	assert.EqualValues(t, 50, entry["output_height"])
+	assert.NotZero(t, entry["source_bytes"])
+	assert.NotZero(t, entry["output_bytes"])
+
+	proxyTestRequest(t, config, server, "/missing.png", nil)
+	entry = logEntry()
+	assert.Equal(t, "info", entry["level"])
+	assert.EqualValues(t, http.StatusNotFound, entry["status"])
+	assert.Equal(t, "upstream error: 404", entry["error"])
+}
+
+func TestServeInvalidRequest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	ServeInvalidRequest(&Configuration{}, rec, "/foo.png", fmt.Errorf("invalid fit"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	buf := &bytes.Buffer{}
+	config := &Configuration{Logger: NewLogger()}
+	config.Logger.Out = buf
+	ServeInvalidRequest(config, httptest.NewRecorder(), "/foo.png", fmt.Errorf("invalid fit"))
+	entry := map[string]interface{}{}
+	require.NoError(t, json.NewDecoder(buf).Decode(&entry))
+	assert.Equal(t, "/foo.png", entry["path"])
+	assert.EqualValues(t, http.StatusBadRequest, entry["status"])
+	assert.Equal(t, "invalid fit", entry["error"])
+}
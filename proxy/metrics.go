@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is a Prometheus collector for proxy requests, origin fetches, filters, and the
+// configuration's caches. A nil *Metrics records nothing.
+type Metrics struct {
+	config *Configuration
+
+	requests         *prometheus.CounterVec
+	requestsInFlight prometheus.Gauge
+	originDuration   prometheus.Histogram
+	originBytes      prometheus.Histogram
+	filterDuration   *prometheus.HistogramVec
+
+	cacheHits      *prometheus.Desc
+	cacheMisses    *prometheus.Desc
+	cacheEvictions *prometheus.Desc
+	cacheEntries   *prometheus.Desc
+	cacheBytes     *prometheus.Desc
+}
+
+var _ prometheus.Collector = &Metrics{}
+
+// NewMetrics creates metrics for proxy requests made with config. It must be registered with a
+// Prometheus registry, and assigned to config.Metrics.
+func NewMetrics(config *Configuration) *Metrics {
+	cacheLabels := []string{"cache"}
+	return &Metrics{
+		config: config,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "image_proxy_requests_total",
+			Help: "Number of proxy requests by status code.",
+		}, []string{"code"}),
+		requestsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "image_proxy_requests_in_flight",
+			Help: "Number of proxy requests being served.",
+		}),
+		originDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "image_proxy_origin_fetch_duration_seconds",
+			Help:    "Time taken to fetch origin images.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		originBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "image_proxy_origin_fetch_bytes",
+			Help:    "Size of fetched origin images.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		filterDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "image_proxy_filter_duration_seconds",
+			Help:    "Time taken by each filter.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"filter"}),
+		cacheHits:      prometheus.NewDesc("image_proxy_cache_hits_total", "Number of cache hits.", cacheLabels, nil),
+		cacheMisses:    prometheus.NewDesc("image_proxy_cache_misses_total", "Number of cache misses.", cacheLabels, nil),
+		cacheEvictions: prometheus.NewDesc("image_proxy_cache_evictions_total", "Number of cache evictions.", cacheLabels, nil),
+		cacheEntries:   prometheus.NewDesc("image_proxy_cache_entries", "Number of cached entries.", cacheLabels, nil),
+		cacheBytes:     prometheus.NewDesc("image_proxy_cache_bytes", "Size of cached entries.", cacheLabels, nil),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.requests, m.requestsInFlight, m.originDuration, m.originBytes, m.filterDuration}
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+	for _, desc := range []*prometheus.Desc{m.cacheHits, m.cacheMisses, m.cacheEvictions, m.cacheEntries, m.cacheBytes} {
+		ch <- desc
+	}
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+
+	caches := map[string]CacheStats{}
+	if m.config.Cache != nil {
+		caches["memory"] = m.config.Cache.Stats()
+	}
+	if m.config.DiskCache != nil {
+		caches["disk"] = m.config.DiskCache.Stats()
+	}
+	for name, stats := range caches {
+		ch <- prometheus.MustNewConstMetric(m.cacheHits, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(m.cacheMisses, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(m.cacheEvictions, prometheus.CounterValue, float64(stats.Evictions), name)
+		ch <- prometheus.MustNewConstMetric(m.cacheEntries, prometheus.GaugeValue, float64(stats.Entries), name)
+		ch <- prometheus.MustNewConstMetric(m.cacheBytes, prometheus.GaugeValue, float64(stats.Bytes), name)
+	}
+}
+
+func (m *Metrics) observeRequestStart() {
+	if m == nil {
+		return
+	}
+	m.requestsInFlight.Inc()
+}
+
+func (m *Metrics) observeRequest(statusCode int) {
+	if m == nil {
+		return
+	}
+	m.requestsInFlight.Dec()
+	m.requests.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+}
+
+// observeInvalidRequest records a request that NewRequest refused, which never reaches Proxy.
+func (m *Metrics) observeInvalidRequest() {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(strconv.Itoa(http.StatusBadRequest)).Inc()
+}
+
+func (m *Metrics) observeOriginFetch(duration time.Duration, bytes int) {
+	if m == nil {
+		return
+	}
+	m.originDuration.Observe(duration.Seconds())
+	m.originBytes.Observe(float64(bytes))
+}
+
+func (m *Metrics) observeFilter(name string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.filterDuration.WithLabelValues(name).Observe(duration.Seconds())
+}
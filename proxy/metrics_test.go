@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequest_FilterNames(t *testing.T) {
+	for query, expected := range map[string][]string{
+		"":                             {"contenttype", "orientation", "encode", "header"},
+		"?fit=10x10&format=png":        {"contenttype", "orientation", "scaling", "png", "encode", "header"},
+		"?rasterize&format=auto":       {"contenttype", "orientation", "rasterize", "autoformat", "encode", "header"},
+		"?rect=0,0,5,5&rotate=90":      {"contenttype", "orientation", "rect", "rotate", "encode", "header"},
+		"?orient=false&flip=h&frame=1": {"contenttype", "frame", "flip", "encode", "header"},
+	} {
+		t.Run(query, func(t *testing.T) {
+			u, err := url.Parse("/foo.example.com/foo.png" + query)
+			require.NoError(t, err)
+			r, err := NewRequestFromURL(u)
+			require.NoError(t, err)
+			var names []string
+			for _, filter := range r.Filters {
+				names = append(names, filter.Name)
+			}
+			assert.Equal(t, expected, names)
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	image := serveTestImage("50x50.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+	config.Cache = NewCache(1 << 20)
+	config.Metrics = NewMetrics(config)
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(config.Metrics))
+
+	proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+	proxyTestRequest(t, config, server, "/missing.png?fit=10x10", nil)
+	ServeInvalidRequest(config, httptest.NewRecorder(), "/foo.png", fmt.Errorf("invalid fit"))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	metrics := map[string][]*dto.Metric{}
+	for _, family := range families {
+		metrics[family.GetName()] = family.GetMetric()
+	}
+
+	labels := func(m *dto.Metric) map[string]string {
+		labels := map[string]string{}
+		for _, pair := range m.GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		return labels
+	}
+
+	requests := map[string]float64{}
+	for _, m := range metrics["image_proxy_requests_total"] {
+		requests[labels(m)["code"]] = m.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"200": 1, "400": 1, "404": 1}, requests)
+
+	require.Len(t, metrics["image_proxy_origin_fetch_duration_seconds"], 1)
+	assert.Equal(t, uint64(1), metrics["image_proxy_origin_fetch_duration_seconds"][0].GetHistogram().GetSampleCount())
+
+	filters := map[string]uint64{}
+	for _, m := range metrics["image_proxy_filter_duration_seconds"] {
+		filters[labels(m)["filter"]] = m.GetHistogram().GetSampleCount()
+	}
+	assert.Equal(t, uint64(1), filters["scaling"])
+	assert.Equal(t, uint64(1), filters["encode"])
+
+	require.Len(t, metrics["image_proxy_cache_misses_total"], 1)
+	assert.Equal(t, "memory", labels(metrics["image_proxy_cache_misses_total"][0])["cache"])
+	assert.Equal(t, float64(2), metrics["image_proxy_cache_misses_total"][0].GetCounter().GetValue())
+}
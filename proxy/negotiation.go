@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// acceptsMediaType reports whether an Accept header explicitly lists the given media type with a
+// non-zero quality. Wildcards are deliberately ignored: many clients send "*/*" or "image/*"
+// without actually supporting newer formats such as WebP.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || t != mediaType {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsMediaType(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Accept   string
+		Expected bool
+	}{
+		"Empty": {
+			Accept:   "",
+			Expected: false,
+		},
+		"Chrome": {
+			Accept:   "image/avif,image/webp,image/apng,image/*,*/*;q=0.8",
+			Expected: true,
+		},
+		"Wildcards": {
+			Accept:   "image/*,*/*;q=0.8",
+			Expected: false,
+		},
+		"ZeroQuality": {
+			Accept:   "image/webp;q=0, image/*",
+			Expected: false,
+		},
+		"Quality": {
+			Accept:   "image/png, image/webp;q=0.5",
+			Expected: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, acceptsMediaType(tc.Accept, "image/webp"))
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// reservedNetworks are the address ranges that origin fetches may not connect to unless they're
+// explicitly allowed via Configuration.AllowedNetworks.
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local, including cloud metadata services
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved, including broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // IPv4/IPv6 translation
+	"100::/64",        // discard
+	"2001:db8::/32",   // documentation
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// forbiddenOriginError is returned when an origin fetch is refused by the configuration.
+type forbiddenOriginError struct {
+	reason string
+}
+
+func (e *forbiddenOriginError) Error() string {
+	return e.reason
+}
+
+// AllowsIP returns whether origin fetches may connect to the given address. Private, loopback,
+// link-local, and other reserved addresses are refused unless they're in one of the allowed
+// networks.
+func (c *Configuration) AllowsIP(ip net.IP) bool {
+	for _, network := range c.AllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialControl is invoked for every connection made to an origin, after the host name has been
+// resolved, so it applies to every address that's tried and every redirect that's followed.
+func (c *Configuration) dialControl(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !c.AllowsIP(ip) {
+		return &forbiddenOriginError{
+			reason: fmt.Sprintf("forbidden origin address: %v", host),
+		}
+	}
+	return nil
+}
+
+func (c *Configuration) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if req.URL.Scheme != "https" && req.URL.Scheme != "http" {
+		return &forbiddenOriginError{
+			reason: "forbidden redirect scheme",
+		}
+	}
+	if !c.AllowsHost(req.URL.Hostname()) {
+		return &forbiddenOriginError{
+			reason: "forbidden redirect host",
+		}
+	}
+	return nil
+}
+
+// originClient returns the HTTP client used to fetch origin images.
+func (c *Configuration) originClient() *http.Client {
+	c.originClientOnce.Do(func() {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   c.dialControl,
+		}
+		c.originClientInstance = &http.Client{
+			Transport: &http.Transport{
+				// Environment proxies are deliberately not used. They would connect on our behalf,
+				// bypassing the address checks.
+				DialContext:           dialer.DialContext,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: 1 * time.Second,
+				TLSClientConfig: &tls.Config{
+					RootCAs: c.originRootCAs,
+				},
+			},
+			CheckRedirect: c.checkRedirect,
+		}
+	})
+	return c.originClientInstance
+}
+
+// parseCIDRs parses a list of networks in CIDR notation. Bare IP addresses are treated as
+// single-address networks.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{
+				IP:   ip,
+				Mask: net.CIDRMask(bits, bits),
+			})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
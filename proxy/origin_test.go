@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfiguration_AllowsIP(t *testing.T) {
+	allowed, err := parseCIDRs([]string{"10.1.0.0/16", "192.168.1.1"})
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		IP       string
+		Expected bool
+	}{
+		"Public":          {IP: "93.184.216.34", Expected: true},
+		"PublicIPv6":      {IP: "2606:2800:220:1:248:1893:25c8:1946", Expected: true},
+		"Loopback":        {IP: "127.0.0.1", Expected: false},
+		"LoopbackIPv6":    {IP: "::1", Expected: false},
+		"Metadata":        {IP: "169.254.169.254", Expected: false},
+		"Private":         {IP: "10.0.0.1", Expected: false},
+		"MappedPrivate":   {IP: "::ffff:10.0.0.1", Expected: false},
+		"UniqueLocal":     {IP: "fd00::1", Expected: false},
+		"Unspecified":     {IP: "0.0.0.0", Expected: false},
+		"AllowedNetwork":  {IP: "10.1.2.3", Expected: true},
+		"AllowedAddress":  {IP: "192.168.1.1", Expected: true},
+		"NeighborAddress": {IP: "192.168.1.2", Expected: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := &Configuration{
+				AllowedNetworks: allowed,
+			}
+			assert.Equal(t, tc.Expected, config.AllowsIP(net.ParseIP(tc.IP)))
+		})
+	}
+}
@@ -1,21 +1,74 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	stderrors "errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Request struct {
 	OriginURL *url.URL
-	Filters   []Filter
+
+	// Header contains the client's request headers that are relevant to the response, such as
+	// Accept for content negotiation.
+	Header http.Header
+
+	// Signature and Expires are given by signed URLs. See SignURL.
+	Signature string
+	Expires   time.Time
+
+	Filters []NamedFilter
+
+	signedMessage  string
+	cacheKey       string
+	transformation string
+
+	// vary lists the request headers that the response varies by.
+	vary []string
+}
+
+// CacheKey returns a key that's the same for all requests that produce the same response.
+func (r *Request) CacheKey() string {
+	return r.cacheKey
+}
+
+// addFilter appends a filter to the request, named as it's reported in metrics and traces.
+func (r *Request) addFilter(name string, filter Filter) {
+	r.Filters = append(r.Filters, NamedFilter{
+		Name:   name,
+		Filter: filter,
+	})
+}
+
+// requestHeaders are the client request headers that are retained in Request.Header.
+var requestHeaders = []string{
+	"Accept",
+	"If-Modified-Since",
+	"If-None-Match",
 }
 
 func parseDimensions(s string) (*Dimensions, error) {
@@ -37,9 +90,101 @@ func parseDimensions(s string) (*Dimensions, error) {
 	}, nil
 }
 
+// parseFocalPoint parses a focal point given as "x,y", where both are fractions from 0 to 1.
+func parseFocalPoint(s string) (*FocalPoint, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid focal point")
+	}
+	point := &FocalPoint{}
+	for i, value := range []*float64{&point.X, &point.Y} {
+		n, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil || !(n >= 0 && n <= 1) {
+			return nil, fmt.Errorf("invalid focal point")
+		}
+		*value = n
+	}
+	return point, nil
+}
+
+// parseRectangle parses a rectangle given as "x,y,width,height". If any of the values are written
+// with a decimal point, they're all fractions of the image's dimensions. Otherwise, they're pixels.
+func parseRectangle(s string) (*Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid rectangle")
+	}
+	rect := &Rectangle{
+		Relative: strings.Contains(s, "."),
+	}
+	values := []*float64{&rect.X, &rect.Y, &rect.Width, &rect.Height}
+	for i, part := range parts {
+		var err error
+		if rect.Relative {
+			*values[i], err = strconv.ParseFloat(part, 64)
+		} else {
+			var n int64
+			n, err = strconv.ParseInt(part, 10, 0)
+			*values[i] = float64(n)
+		}
+		if err != nil || *values[i] < 0 || math.IsNaN(*values[i]) || math.IsInf(*values[i], 0) {
+			return nil, fmt.Errorf("invalid rectangle")
+		}
+	}
+	if rect.Width == 0 || rect.Height == 0 {
+		return nil, fmt.Errorf("invalid rectangle")
+	}
+	if rect.Relative && (rect.X+rect.Width > 1 || rect.Y+rect.Height > 1) {
+		return nil, fmt.Errorf("invalid rectangle")
+	}
+	return rect, nil
+}
+
+// parseColor parses a color given as hexadecimal RRGGBB or RRGGBBAA.
+func parseColor(s string) (color.Color, error) {
+	if len(s) != 6 && len(s) != 8 {
+		return nil, fmt.Errorf("invalid color")
+	}
+	if len(s) == 6 {
+		s += "ff"
+	}
+	n, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid color")
+	}
+	return color.NRGBA{
+		R: uint8(n >> 24),
+		G: uint8(n >> 16),
+		B: uint8(n >> 8),
+		A: uint8(n),
+	}, nil
+}
+
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"":        png.DefaultCompression,
+	"default": png.DefaultCompression,
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"best":    png.BestCompression,
+}
+
 // NewProxyRequestFromURL parses a URL for the origin url and additional options.
 func NewRequestFromURL(url *url.URL) (*Request, error) {
-	r := &Request{}
+	return NewRequest(url, nil)
+}
+
+// NewRequest parses a URL for the origin url and additional options. The client's request headers
+// are used to negotiate the output format if "format=auto" is given.
+func NewRequest(url *url.URL, header http.Header) (*Request, error) {
+	r := &Request{
+		Header: http.Header{},
+	}
+	for _, name := range requestHeaders {
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if v, ok := header[canonical]; ok {
+			r.Header[canonical] = v
+		}
+	}
 
 	var err error
 
@@ -48,18 +193,39 @@ func NewRequestFromURL(url *url.URL) (*Request, error) {
 		return nil, err
 	}
 
+	r.Signature = url.Query().Get(signatureParameter)
+	r.signedMessage = canonicalSigningMessage(url)
+	if param := url.Query().Get(expiresParameter); param != "" {
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires")
+		}
+		r.Expires = time.Unix(n, 0)
+	}
+
 	scalingOptions := &ScalingOptions{}
 
 	if crop := url.Query().Get("crop"); crop != "" {
 		cropType := CropType(crop)
 
-		if _, ok := cropTypeToAnchor[cropType]; !ok {
+		if _, ok := cropTypeToAnchor[cropType]; !ok && cropType != CropTypeSmart {
 			return nil, fmt.Errorf("invalid crop: %v", crop)
 		} else {
 			scalingOptions.Crop = &cropType
 		}
 	}
 
+	if focus := url.Query().Get("focus"); focus != "" {
+		if scalingOptions.Crop != nil {
+			return nil, fmt.Errorf("focus can't be combined with crop")
+		}
+		point, err := parseFocalPoint(focus)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid focus")
+		}
+		scalingOptions.Focus = point
+	}
+
 	var scalingFunction ScalingFunction
 	if fit := url.Query().Get("fit"); fit != "" {
 		if dim, err := parseDimensions(fit); err != nil {
@@ -77,54 +243,371 @@ func NewRequestFromURL(url *url.URL) (*Request, error) {
 		}
 	}
 
-	r.Filters = append(r.Filters, ContentTypeFilter)
+	if param := url.Query().Get("rect"); param != "" {
+		rect, err := parseRectangle(param)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid rect")
+		}
+		scalingOptions.Rect = rect
+	}
+
+	if _, ok := url.Query()["upscale"]; ok {
+		upscale := true
+		if param := url.Query().Get("upscale"); param != "" {
+			if upscale, err = strconv.ParseBool(param); err != nil {
+				return nil, fmt.Errorf("invalid upscale")
+			}
+		}
+		scalingOptions.Upscale = &upscale
+	}
+
+	// JPEG images are made upright according to their EXIF orientation unless told otherwise.
+	orientation := true
+	if param := url.Query().Get("orient"); param != "" {
+		if orientation, err = strconv.ParseBool(param); err != nil {
+			return nil, fmt.Errorf("invalid orient")
+		}
+	}
+
+	r.addFilter("contenttype", ContentTypeFilter)
+
+	if orientation {
+		r.addFilter("orientation", OrientationFilter)
+	}
+
+	if param := url.Query().Get("frame"); param != "" {
+		n, err := strconv.ParseInt(param, 10, 0)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid frame")
+		}
+		r.addFilter("frame", FrameFilter(int(n)))
+	}
+
+	var rotateFilter Filter
+	if param := url.Query().Get("rotate"); param != "" {
+		angle, err := strconv.ParseFloat(param, 64)
+		if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+			return nil, fmt.Errorf("invalid rotate")
+		}
+		angle = angle - math.Floor(angle/360)*360
+
+		var background color.Color = color.NRGBA{}
+		if param := url.Query().Get("background"); param != "" {
+			if background, err = parseColor(param); err != nil {
+				return nil, errors.Wrap(err, "invalid background")
+			}
+		}
+
+		if angle != 0 {
+			rotateFilter = RotateFilter(angle, background)
+		}
+
+		// Quarter turns swap the dimensions, so vector images are rasterized to fit the rotated
+		// bounds. Other angles are scaled after rotation.
+		if scalingFunction != nil && (angle == 90 || angle == 270) {
+			f := scalingFunction
+			scalingFunction = func(width, height int, allowUpscaling bool) (int, int) {
+				width, height = f(height, width, allowUpscaling)
+				return height, width
+			}
+		}
+	}
+
+	var flipFilter Filter
+	if param := url.Query().Get("flip"); param != "" {
+		switch param {
+		case "h":
+			flipFilter = FlipFilter(true, false)
+		case "v":
+			flipFilter = FlipFilter(false, true)
+		case "hv", "vh":
+			flipFilter = FlipFilter(true, true)
+		default:
+			return nil, fmt.Errorf("invalid flip")
+		}
+	}
 
 	if _, ok := url.Query()["rasterize"]; ok {
-		r.Filters = append(r.Filters, RasterizeFilter(scalingFunction))
+		// Vector images are upscaled unless told otherwise.
+		upscale := scalingOptions.Upscale == nil || *scalingOptions.Upscale
+		r.addFilter("rasterize", RasterizeFilter(scalingFunction, upscale, scalingOptions.Rect))
+	}
+
+	// The region is given in the coordinates of the source image, so it's extracted before the image
+	// is rotated or flipped.
+	if scalingOptions.Rect != nil && (rotateFilter != nil || flipFilter != nil) {
+		r.addFilter("rect", ScalingFilter(&ScalingOptions{
+			Rect: scalingOptions.Rect,
+		}))
+		scalingOptions.Rect = nil
+	}
+
+	// Images are rotated and flipped before they're scaled so that they fit the requested bounds.
+	if rotateFilter != nil {
+		r.addFilter("rotate", rotateFilter)
+	}
+	if flipFilter != nil {
+		r.addFilter("flip", flipFilter)
 	}
 
 	if scalingOptions.IsValid() {
-		r.Filters = append(r.Filters, ScalingFilter(scalingOptions))
+		r.addFilter("scaling", ScalingFilter(scalingOptions))
 	}
 
 	if format := url.Query().Get("format"); format != "" {
+		quality := 98
+		if param := url.Query().Get("quality"); param != "" {
+			n, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("invalid quality")
+			}
+			quality = int(n)
+		}
+
 		switch format {
+		case "auto":
+			r.addFilter("autoformat", AutoFormatFilter(r.Header.Get("Accept"), quality))
+			r.vary = append(r.vary, "Accept")
 		case "jpeg", "jpg":
-			quality := 98
-			if param := url.Query().Get("quality"); param != "" {
+			r.addFilter("jpeg", JPEGFilter(quality))
+		case "png":
+			compression, ok := pngCompressionLevels[url.Query().Get("compression")]
+			if !ok {
+				return nil, fmt.Errorf("invalid compression")
+			}
+			colors := 0
+			if param := url.Query().Get("colors"); param != "" {
 				n, err := strconv.ParseInt(param, 10, 64)
-				if err != nil || n < 1 || n > 100 {
-					return nil, fmt.Errorf("invalid quality")
+				if err != nil || n < 2 || n > 256 {
+					return nil, fmt.Errorf("invalid colors")
+				}
+				colors = int(n)
+			}
+			r.addFilter("png", PNGFilter(compression, colors))
+		case "webp":
+			_, lossless := url.Query()["lossless"]
+			if param := url.Query().Get("lossless"); param != "" {
+				if lossless, err = strconv.ParseBool(param); err != nil {
+					return nil, fmt.Errorf("invalid lossless")
 				}
-				quality = int(n)
 			}
-			r.Filters = append(r.Filters, JPEGFilter(quality))
+			r.addFilter("webp", WebPFilter(quality, lossless))
 		default:
 			return nil, fmt.Errorf("invalid format")
 		}
 	}
 
-	r.Filters = append(r.Filters, HeaderFilter)
+	r.addFilter("encode", EncodeFilter)
+	r.addFilter("header", HeaderFilter)
+
+	r.cacheKey = cacheKey(r.OriginURL, url.Query(), r.Header)
+	r.transformation = transformationParameters(url.Query()).Encode()
 
 	return r, nil
 }
 
 type Response struct {
 	Header http.Header
-	Body   io.Reader
+
+	// Body is the encoded image. It's nil while the image has been decoded and not yet encoded
+	// again.
+	Body io.Reader
+
+	// Image is the decoded image, if any filter has needed to decode it.
+	Image *Image
+
+	// config is the configuration of the Proxy call that's filtering the response. It's nil when
+	// filters are used on their own.
+	config *Configuration
+
+	// ctx is the context of the filter's span.
+	ctx context.Context
+}
+
+// Context returns the context of the request being filtered, which carries its trace. Filters that
+// do their own tracing can start child spans with it.
+func (r *Response) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// Image is a decoded raster image. Animated images have more than one frame, each of which is a
+// complete rendering of the canvas.
+type Image struct {
+	Frames []image.Image
+
+	// Delays and LoopCount describe the timing of animated images, as in gif.GIF.
+	Delays    []int
+	LoopCount int
+
+	// scale is the ratio of the image's dimensions to those of the vector image it was rasterized
+	// from, if any. Zero means the image wasn't rasterized.
+	scale float64
+}
+
+// transform returns a copy of the image with f applied to every frame.
+func (img *Image) transform(f func(image.Image) image.Image) *Image {
+	out := &Image{
+		Frames:    make([]image.Image, len(img.Frames)),
+		Delays:    img.Delays,
+		LoopCount: img.LoopCount,
+		scale:     img.scale,
+	}
+	for i, frame := range img.Frames {
+		out.Frames[i] = f(frame)
+	}
+	return out
 }
 
 type Configuration struct {
 	AllowedHosts []string
+
+	// If SigningKeys is non-empty, requests must be signed with one of the keys. See SignURL.
+	SigningKeys [][]byte
+
+	// AllowedNetworks are networks that origin fetches may connect to even though they're private
+	// or otherwise reserved. See AllowsIP.
+	AllowedNetworks []*net.IPNet
+
+	// MaxOriginBytes limits the size of origin images. MaxSourcePixels limits the number of pixels
+	// decoded from origin images, counting every frame of animated images. MaxSVGPixels limits the
+	// size of the surface vector images are rasterized to. Zero selects the default limit, and a
+	// negative value disables the limit.
+	MaxOriginBytes  int64
+	MaxSourcePixels int64
+	MaxSVGPixels    int64
+
+	// MaxOutputWidth and MaxOutputHeight limit the dimensions of scaled and rasterized images.
+	// Larger outputs are scaled down to fit. Zero selects the default limit, and a negative value
+	// disables the limit.
+	MaxOutputWidth  int64
+	MaxOutputHeight int64
+
+	// CachePolicy overrides the caching headers of responses. HostCachePolicies override the fields
+	// they set for specific origin hosts.
+	CachePolicy       *CachePolicy
+	HostCachePolicies []HostCachePolicy
+
+	// If Cache is non-nil, responses are cached in it.
+	Cache *Cache
+
+	// If DiskCache is non-nil, responses and origin images are cached in it.
+	DiskCache *DiskCache
+
+	// If Logger is non-nil, every request is logged to it. See NewLogger.
+	Logger *logrus.Logger
+
+	// If Metrics is non-nil, metrics are recorded for requests. See NewMetrics.
+	Metrics *Metrics
+
+	// If TracerProvider is non-nil, requests are traced with spans for the origin fetch, each
+	// filter, and the response write. See NewTracerProvider.
+	TracerProvider trace.TracerProvider
+
+	// flights coalesces concurrent identical requests.
+	flights flightGroup
+
+	// originRootCAs overrides the system's root certificates for origin fetches. It's used by tests.
+	originRootCAs *x509.CertPool
+
+	originClientOnce     sync.Once
+	originClientInstance *http.Client
 }
 
-func (c *Configuration) LoadEnvironmentVariables() {
+func (c *Configuration) LoadEnvironmentVariables() error {
 	if hosts := os.Getenv("IMAGE_PROXY_ALLOWED_HOSTS"); hosts != "" {
 		c.AllowedHosts = strings.Split(hosts, ",")
 		for i, host := range c.AllowedHosts {
 			c.AllowedHosts[i] = strings.TrimSpace(host)
 		}
 	}
+
+	if keys := os.Getenv("IMAGE_PROXY_SIGNING_KEYS"); keys != "" {
+		c.SigningKeys = nil
+		for _, key := range strings.Split(keys, ",") {
+			// Anyone could sign URLs with an empty key, so empty entries are skipped.
+			if key = strings.TrimSpace(key); key != "" {
+				c.SigningKeys = append(c.SigningKeys, []byte(key))
+			}
+		}
+		if len(c.SigningKeys) == 0 {
+			return fmt.Errorf("invalid IMAGE_PROXY_SIGNING_KEYS")
+		}
+	}
+
+	for name, limit := range map[string]*int64{
+		"IMAGE_PROXY_MAX_ORIGIN_BYTES":  &c.MaxOriginBytes,
+		"IMAGE_PROXY_MAX_SOURCE_PIXELS": &c.MaxSourcePixels,
+		"IMAGE_PROXY_MAX_SVG_PIXELS":    &c.MaxSVGPixels,
+		"IMAGE_PROXY_MAX_OUTPUT_WIDTH":  &c.MaxOutputWidth,
+		"IMAGE_PROXY_MAX_OUTPUT_HEIGHT": &c.MaxOutputHeight,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid %v", name)
+			}
+			*limit = n
+		}
+	}
+
+	if size := os.Getenv("IMAGE_PROXY_CACHE_SIZE"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_CACHE_SIZE")
+		}
+		c.Cache = nil
+		if n > 0 {
+			c.Cache = NewCache(n)
+		}
+	}
+
+	if policy := os.Getenv("IMAGE_PROXY_CACHE_POLICY"); policy != "" {
+		var err error
+		if c.CachePolicy, err = parseCachePolicy(policy); err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_CACHE_POLICY")
+		}
+	}
+
+	if policies := os.Getenv("IMAGE_PROXY_HOST_CACHE_POLICIES"); policies != "" {
+		var err error
+		if c.HostCachePolicies, err = parseHostCachePolicies(policies); err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_HOST_CACHE_POLICIES")
+		}
+	}
+
+	if level := os.Getenv("IMAGE_PROXY_LOG_LEVEL"); level != "" {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_LOG_LEVEL")
+		}
+		if c.Logger == nil {
+			c.Logger = NewLogger()
+		}
+		c.Logger.SetLevel(l)
+	}
+
+	if exporter := os.Getenv("IMAGE_PROXY_TRACE_EXPORTER"); exporter != "" {
+		var err error
+		if c.TracerProvider, err = NewTracerProvider(exporter); err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_TRACE_EXPORTER")
+		}
+	}
+
+	if networks := os.Getenv("IMAGE_PROXY_ALLOWED_NETWORKS"); networks != "" {
+		cidrs := strings.Split(networks, ",")
+		for i, cidr := range cidrs {
+			cidrs[i] = strings.TrimSpace(cidr)
+		}
+		var err error
+		if c.AllowedNetworks, err = parseCIDRs(cidrs); err != nil {
+			return errors.Wrap(err, "invalid IMAGE_PROXY_ALLOWED_NETWORKS")
+		}
+	}
+
+	return nil
 }
 
 func (c *Configuration) AllowsHost(host string) bool {
@@ -139,44 +622,325 @@ func (c *Configuration) AllowsHost(host string) bool {
 	return false
 }
 
-func Proxy(config *Configuration, w http.ResponseWriter, r *Request) {
+// Proxy serves a request. The request's spans are children of any span in ctx. See
+// ExtractTraceContext.
+func Proxy(ctx context.Context, config *Configuration, w http.ResponseWriter, r *Request) {
+	l := &requestLog{
+		start: time.Now(),
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+	var res *result
+
+	ctx, span := config.tracer().Start(ctx, "proxy", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("image_proxy.origin_host", r.OriginURL.Host),
+		attribute.String("image_proxy.transformation", r.transformation),
+	))
+
+	config.Metrics.observeRequestStart()
+	defer func() {
+		status := recorder.status()
+		config.Metrics.observeRequest(status)
+		config.logRequest(r, recorder, res, l)
+
+		span.SetAttributes(
+			attribute.Int("http.response.status_code", status),
+			attribute.String("image_proxy.cache", l.cache),
+		)
+		if l.err != nil {
+			span.RecordError(l.err)
+		}
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+	}()
+
+	policy := config.cachePolicy(r.OriginURL.Host)
+
+	if err := config.VerifySignature(r); err != nil {
+		l.err = err
+		policy.writeError(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
 	if !config.AllowsHost(r.OriginURL.Host) {
-		http.Error(w, "forbidden host", http.StatusForbidden)
+		policy.writeError(w, "forbidden host", http.StatusForbidden)
 		return
 	}
 
-	resp, err := http.Get(r.OriginURL.String())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if res = config.Cache.get(r.cacheKey, time.Now()); res != nil {
+		l.cache = "memory"
+		config.write(ctx, w, r, res)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		if resp.StatusCode >= 400 {
-			http.Error(w, fmt.Sprintf("upstream error: %v", resp.StatusCode), resp.StatusCode)
-		} else {
-			http.Error(w, fmt.Sprintf("upstream status code: %v", resp.StatusCode), http.StatusBadGateway)
+	// Conditional requests may be answered without running the filters, so they only share results
+	// with identical conditional requests.
+	flightKey := r.cacheKey
+	if isConditional(r.Header) {
+		flightKey += "\n" + r.Header.Get("If-None-Match") + "\n" + r.Header.Get("If-Modified-Since")
+	}
+
+	// Requests that join the flight depend on its result, so it isn't canceled with the request that
+	// started it.
+	flightCtx := context.WithoutCancel(ctx)
+
+	var err *FilterError
+	var shared bool
+	res, err, shared = config.flights.do(flightKey, func() (*result, *FilterError) {
+		if cached := config.DiskCache.get(r.cacheKey, time.Now()); cached != nil {
+			l.cache = "disk"
+			return cached, nil
+		}
+		stale := config.Cache.stale(r.cacheKey)
+		if stale == nil {
+			stale = config.DiskCache.stale(r.cacheKey)
 		}
+		result, err := config.process(flightCtx, r, stale, l)
+		if err != nil {
+			return nil, err
+		}
+		policy.apply(result.Header, time.Now())
+		if !result.notModified {
+			config.Cache.add(r.cacheKey, result, time.Now())
+			config.DiskCache.add(r.cacheKey, result, time.Now())
+		}
+		return result, nil
+	})
+	if shared {
+		l.cache = "coalesced"
+	}
+	if err != nil {
+		l.err = err.Error
+		policy.writeError(w, err.Error.Error(), err.StatusCode)
 		return
 	}
+	config.write(ctx, w, r, res)
+}
+
+// ServeInvalidRequest responds to a request for path that NewRequest refused with 400 Bad Request,
+// and records it in the logs and metrics. The response has the caching headers given by the cache
+// policy of the origin host.
+func ServeInvalidRequest(config *Configuration, w http.ResponseWriter, path string, err error) {
+	config.logInvalidRequest(path, err)
+	config.Metrics.observeInvalidRequest()
+	host := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	config.cachePolicy(host).writeError(w, err.Error(), http.StatusBadRequest)
+}
+
+// write writes a result in its own span.
+func (c *Configuration) write(ctx context.Context, w http.ResponseWriter, r *Request, res *result) {
+	_, span := c.tracer().Start(ctx, "write")
+	defer span.End()
+	res.write(w, r.Header)
+}
+
+// process fetches the origin image and runs the request's filters on it. If a stale result is given,
+// it's revalidated with the origin and refreshed if the origin image hasn't changed. The details of
+// the processing are recorded in l.
+func (c *Configuration) process(ctx context.Context, r *Request, stale *result, l *requestLog) (*result, *FilterError) {
+	l.cache = "miss"
 
+	originKey := "origin " + r.OriginURL.String()
+	origin := c.DiskCache.get(originKey, time.Now())
+	if origin == nil {
+		// Revalidating the stale result lets us skip the filters entirely. Otherwise, a stale origin
+		// image can at least save us the download.
+		var validators http.Header
+		staleOrigin := c.DiskCache.stale(originKey)
+		if stale != nil && len(stale.Validators) > 0 {
+			validators = stale.Validators
+		} else if staleOrigin != nil {
+			validators = originValidators(staleOrigin.Header)
+		}
+
+		start := time.Now()
+		fetched, err := c.fetchOrigin(ctx, r.OriginURL, validators)
+		l.originDuration = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+		if fetched.notModified {
+			if stale != nil && len(stale.Validators) > 0 {
+				l.cache = "revalidated"
+				return stale.refreshed(fetched.Header), nil
+			}
+			fetched = staleOrigin.refreshed(fetched.Header)
+		}
+		origin = fetched
+		c.DiskCache.add(originKey, origin, time.Now())
+	}
+
+	l.sourceBytes = len(origin.Body)
+	l.sourceWidth, l.sourceHeight = imageDimensions(origin.Header, origin.Body)
+
+	// The ETag only depends on the origin image and the request, so conditional requests can be
+	// answered before running any filters.
+	etag := entityTag(origin, r.cacheKey)
+	validators := http.Header{
+		"Last-Modified": origin.Header["Last-Modified"],
+	}
+	validators.Set("ETag", etag)
+	if notModified(r.Header, validators) {
+		header := http.Header{}
+		for _, name := range []string{"Cache-Control", "Expires", "Last-Modified"} {
+			if v, ok := origin.Header[name]; ok {
+				header[name] = v
+			}
+		}
+		for _, name := range r.vary {
+			header.Add("Vary", name)
+		}
+		header.Set("ETag", etag)
+		return &result{
+			Header:      header,
+			notModified: true,
+		}, nil
+	}
+
+	header := http.Header{}
+	for k, v := range origin.Header {
+		header[k] = v
+	}
 	out := &Response{
-		Header: resp.Header,
-		Body:   resp.Body,
+		Header: header,
+		Body:   bytes.NewReader(origin.Body),
+		config: c,
 	}
 
 	for _, filter := range r.Filters {
-		var err *FilterError
-		out, err = filter(out)
-		if err != nil {
-			http.Error(w, err.Error.Error(), err.StatusCode)
-			return
+		filterCtx, span := c.tracer().Start(ctx, "filter "+filter.Name)
+		out.ctx = filterCtx
+		start := time.Now()
+		var filterErr *FilterError
+		out, filterErr = filter.Filter(out)
+		c.Metrics.observeFilter(filter.Name, time.Since(start))
+		l.filterDuration += time.Since(start)
+		if filterErr != nil {
+			span.RecordError(filterErr.Error)
+			span.SetStatus(codes.Error, filterErr.Error.Error())
+			span.End()
+			return nil, filterErr
+		}
+		span.End()
+		out.config = c
+	}
+
+	output, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, &FilterError{
+			Error:      err,
+			StatusCode: http.StatusInternalServerError,
 		}
 	}
 
-	for k, v := range out.Header {
-		w.Header()[k] = v
+	out.Header.Set("ETag", etag)
+
+	return &result{
+		Header:     out.Header,
+		Body:       output,
+		Validators: originValidators(origin.Header),
+	}, nil
+}
+
+// fetchOrigin fetches an origin image. If validators are given, the request is conditional, and the
+// result is marked as not modified if the origin responds with 304 Not Modified.
+func (c *Configuration) fetchOrigin(ctx context.Context, originURL *url.URL, validators http.Header) (res *result, filterErr *FilterError) {
+	ctx, span := c.tracer().Start(ctx, "origin fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("url.full", originURL.String()),
+	))
+	defer func() {
+		if filterErr != nil {
+			span.RecordError(filterErr.Error)
+			span.SetStatus(codes.Error, filterErr.Error.Error())
+		} else if !res.notModified {
+			span.SetAttributes(attribute.Int("image_proxy.origin_bytes", len(res.Body)))
+		}
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", originURL.String(), nil)
+	if err != nil {
+		return nil, &FilterError{
+			Error:      err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	if etag := validators.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
-	io.Copy(w, out.Body)
+	if lastModified := validators.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	start := time.Now()
+	resp, err := c.originClient().Do(req)
+	if err != nil {
+		var forbidden *forbiddenOriginError
+		if stderrors.As(err, &forbidden) {
+			return nil, &FilterError{
+				Error:      forbidden,
+				StatusCode: http.StatusForbidden,
+			}
+		}
+		return nil, &FilterError{
+			Error:      err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode == http.StatusNotModified && len(validators) > 0 {
+		return &result{
+			Header:      resp.Header,
+			notModified: true,
+		}, nil
+	}
+
+	if resp.StatusCode != 200 {
+		if resp.StatusCode >= 400 {
+			return nil, &FilterError{
+				Error:      fmt.Errorf("upstream error: %v", resp.StatusCode),
+				StatusCode: resp.StatusCode,
+			}
+		}
+		return nil, &FilterError{
+			Error:      fmt.Errorf("upstream status code: %v", resp.StatusCode),
+			StatusCode: http.StatusBadGateway,
+		}
+	}
+
+	maxBytes := c.maxOriginBytes()
+	if maxBytes > 0 && resp.ContentLength > maxBytes {
+		return nil, &FilterError{
+			Error:      fmt.Errorf("origin image too large"),
+			StatusCode: statusTooLarge,
+		}
+	}
+
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, &FilterError{
+			Error:      err,
+			StatusCode: http.StatusInternalServerError,
+		}
+	}
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		return nil, &FilterError{
+			Error:      fmt.Errorf("origin image too large"),
+			StatusCode: statusTooLarge,
+		}
+	}
+	c.Metrics.observeOriginFetch(time.Since(start), len(data))
+
+	return &result{
+		Header: resp.Header,
+		Body:   data,
+	}, nil
 }
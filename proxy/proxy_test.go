@@ -1,9 +1,18 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,6 +55,41 @@ func TestConfiguration_AllowsHost(t *testing.T) {
 	}
 }
 
+func TestNewRequest(t *testing.T) {
+	url, err := url.Parse("/foo.example.com/foo.png?format=auto")
+	require.NoError(t, err)
+
+	request, err := NewRequest(url, http.Header{
+		"Accept": []string{"image/webp"},
+		"Cookie": []string{"foo=bar"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://foo.example.com/foo.png", request.OriginURL.String())
+	assert.Equal(t, http.Header{
+		"Accept": []string{"image/webp"},
+	}, request.Header)
+}
+
+func TestNewRequest_Upscale(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"fit=10x10&upscale":       true,
+		"fit=10x10&upscale=true":  true,
+		"fit=10x10&upscale=false": true,
+		"fit=10x10&upscale=maybe": false,
+	} {
+		t.Run(query, func(t *testing.T) {
+			url, err := url.Parse("/foo.example.com/foo.png?" + query)
+			require.NoError(t, err)
+			_, err = NewRequestFromURL(url)
+			if valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
 func TestProxy(t *testing.T) {
 	for name, tc := range map[string]struct {
 		Configuration      *Configuration
@@ -59,6 +103,13 @@ func TestProxy(t *testing.T) {
 			URL:                "baz.example.com/foo.png",
 			ExpectedStatusCode: http.StatusForbidden,
 		},
+		"Unsigned": {
+			Configuration: &Configuration{
+				SigningKeys: [][]byte{[]byte("key")},
+			},
+			URL:                "foo.example.com/foo.png",
+			ExpectedStatusCode: http.StatusForbidden,
+		},
 	} {
 		t.Run(name, func(t *testing.T) {
 			url, err := url.Parse(tc.URL)
@@ -72,7 +123,7 @@ func TestProxy(t *testing.T) {
 			require.NoError(t, err)
 
 			rec := httptest.NewRecorder()
-			Proxy(config, rec, request)
+			Proxy(context.Background(), config, rec, request)
 			result := rec.Result()
 			defer result.Body.Close()
 
@@ -80,3 +131,312 @@ func TestProxy(t *testing.T) {
 		})
 	}
 }
+
+// newTestOrigin starts an HTTPS origin on the loopback interface and returns a configuration that
+// is allowed to fetch from it.
+func newTestOrigin(t *testing.T, handler http.Handler) (*httptest.Server, *Configuration) {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+
+	networks, err := parseCIDRs([]string{"127.0.0.0/8", "::1"})
+	require.NoError(t, err)
+
+	return server, &Configuration{
+		AllowedNetworks: networks,
+		originRootCAs:   rootCAs,
+	}
+}
+
+// serveTestImage serves the given test image as a PNG.
+func serveTestImage(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(getImage(name))
+	})
+}
+
+// proxyTestRequest proxies a request for the given path and query on the test origin.
+func proxyTestRequest(t *testing.T, config *Configuration, server *httptest.Server, pathAndQuery string, header http.Header) *http.Response {
+	u, err := url.Parse("/" + strings.TrimPrefix(server.URL, "https://") + pathAndQuery)
+	require.NoError(t, err)
+	request, err := NewRequest(u, header)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	Proxy(context.Background(), config, rec, request)
+	return rec.Result()
+}
+
+func TestProxy_OriginAddresses(t *testing.T) {
+	t.Run("Allowed", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		result := proxyTestRequest(t, config, server, "/foo.png", nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, "image/png", result.Header.Get("Content-Type"))
+	})
+
+	t.Run("Loopback", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		config.AllowedNetworks = nil
+		result := proxyTestRequest(t, config, server, "/foo.png", nil)
+		assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		server, config := newTestOrigin(t, http.RedirectHandler("https://169.254.169.254/latest/meta-data/", http.StatusFound))
+		result := proxyTestRequest(t, config, server, "/foo.png", nil)
+		assert.Equal(t, http.StatusForbidden, result.StatusCode)
+	})
+}
+
+func TestProxy_Limits(t *testing.T) {
+	t.Run("OriginBytes", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		config.MaxOriginBytes = 100
+		result := proxyTestRequest(t, config, server, "/foo.png", nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+	})
+
+	t.Run("OriginBytesStreamed", func(t *testing.T) {
+		server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, 1000))
+		}))
+		config.MaxOriginBytes = 100
+		result := proxyTestRequest(t, config, server, "/foo.png", nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+	})
+
+	t.Run("SourcePixels", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		config.MaxSourcePixels = 49 * 50
+		result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+
+		config.MaxSourcePixels = 50 * 50
+		result = proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+	})
+
+	t.Run("SourcePixelsAutoFormat", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		config.MaxSourcePixels = 49 * 50
+		result := proxyTestRequest(t, config, server, "/foo.png?format=auto", nil)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, result.StatusCode)
+	})
+
+	t.Run("SVGPixelsDefault", func(t *testing.T) {
+		config := &Configuration{}
+		width, height := config.maxOutputDimensions()
+		assert.True(t, config.maxSVGPixels() >= int64(width)*int64(height))
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+		config.MaxOriginBytes = -1
+		config.MaxSourcePixels = -1
+		result := proxyTestRequest(t, config, server, "/foo.png?fit=10x10", nil)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+	})
+}
+
+func TestNewRequest_Rotate(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"rotate=90":                     true,
+		"rotate=-45&background=ff0000":  true,
+		"rotate=30&background=ff000080": true,
+		"rotate=30&background=red":      false,
+		"rotate=foo":                    false,
+		"rotate=NaN":                    false,
+		"flip=h":                        true,
+		"flip=hv":                       true,
+		"flip=x":                        false,
+	} {
+		t.Run(query, func(t *testing.T) {
+			url, err := url.Parse("/foo.example.com/foo.png?" + query)
+			require.NoError(t, err)
+			_, err = NewRequestFromURL(url)
+			if valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestProxy_Lossless(t *testing.T) {
+	server, config := newTestOrigin(t, serveTestImage("50x50.png"))
+
+	for query, chunk := range map[string]string{
+		"":                "VP8 ",
+		"&lossless":       "VP8L",
+		"&lossless=true":  "VP8L",
+		"&lossless=false": "VP8 ",
+	} {
+		t.Run(query, func(t *testing.T) {
+			result := proxyTestRequest(t, config, server, "/foo.png?format=webp"+query, nil)
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			body, err := ioutil.ReadAll(result.Body)
+			require.NoError(t, err)
+			require.True(t, len(body) > 16)
+			assert.Equal(t, chunk, string(body[12:16]))
+		})
+	}
+
+	u, err := url.Parse("/foo.example.com/foo.png?format=webp&lossless=foo")
+	require.NoError(t, err)
+	_, err = NewRequestFromURL(u)
+	assert.EqualError(t, err, "invalid lossless")
+}
+
+func TestProxy_Rotate(t *testing.T) {
+	server, config := newTestOrigin(t, serveTestImage("200x100.png"))
+
+	for query, expected := range map[string]image.Point{
+		"?rotate=90":                             image.Pt(100, 200),
+		"?rotate=450":                            image.Pt(100, 200),
+		"?rotate=-90&fit=50x50":                  image.Pt(25, 50),
+		"?rotate=270&flip=v&fill=50x50&crop=top": image.Pt(50, 50),
+		"?rotate=45&fit=100x100":                 image.Pt(100, 100),
+	} {
+		t.Run(query, func(t *testing.T) {
+			result := proxyTestRequest(t, config, server, "/foo.png"+query, nil)
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			img, err := png.Decode(result.Body)
+			require.NoError(t, err)
+			assert.Equal(t, expected, img.Bounds().Size())
+		})
+	}
+}
+
+func TestParseRectangle(t *testing.T) {
+	for s, expected := range map[string]*Rectangle{
+		"10,20,30,40":   {X: 10, Y: 20, Width: 30, Height: 40},
+		"0.25,0,0.5,1":  {X: 0.25, Y: 0, Width: 0.5, Height: 1, Relative: true},
+		"10,20,30":      nil,
+		"10,20,0,40":    nil,
+		"-10,20,30,40":  nil,
+		"10.5,20,30,40": nil,
+		"0.5,0,0.6,1":   nil,
+		"foo,20,30,40":  nil,
+	} {
+		t.Run(s, func(t *testing.T) {
+			rect, err := parseRectangle(s)
+			if expected == nil {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, expected, rect)
+			}
+		})
+	}
+}
+
+func TestProxy_Rect(t *testing.T) {
+	server, config := newTestOrigin(t, serveTestImage("200x100.png"))
+
+	for query, expected := range map[string]image.Point{
+		"?rect=0,0,100,100":                     image.Pt(100, 100),
+		"?rect=0,0,0.5,1.0&fit=50x50":           image.Pt(50, 50),
+		"?rect=100,0,100,50&fill=20x20":         image.Pt(40, 20),
+		"?rotate=90&rect=0,0,100,100&fit=50x50": image.Pt(50, 50),
+	} {
+		t.Run(query, func(t *testing.T) {
+			result := proxyTestRequest(t, config, server, "/foo.png"+query, nil)
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			img, err := png.Decode(result.Body)
+			require.NoError(t, err)
+			assert.Equal(t, expected, img.Bounds().Size())
+		})
+	}
+
+	result := proxyTestRequest(t, config, server, "/foo.png?rect=0,0,200,200", nil)
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+}
+
+func TestProxy_RectRotated(t *testing.T) {
+	// The source is white with a red square in its top-left corner.
+	source := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(source, source.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(source, image.Rect(0, 0, 50, 50), image.NewUniform(color.RGBA{0xff, 0x00, 0x00, 0xff}), image.Point{}, draw.Src)
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, source))
+
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/foo.svg" {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="200" height="100"><rect width="200" height="100" fill="#ff0000"/></svg>`))
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+
+	// The region is in the source's coordinates, so its top-left 100x50 pixels are extracted, then
+	// rotated so that the red square is on top.
+	result := proxyTestRequest(t, config, server, "/foo.png?rotate=90&rect=0,0,100,50", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	img, err := png.Decode(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(50, 100), img.Bounds().Size())
+	assertColor(t, color.RGBA{0xff, 0x00, 0x00, 0xff}, img.At(25, 25))
+	assertColor(t, color.RGBA{0xff, 0xff, 0xff, 0xff}, img.At(25, 75))
+
+	// Vector images are rasterized so that the rotated region fits the requested bounds.
+	result = proxyTestRequest(t, config, server, "/foo.svg?rasterize&rotate=90&rect=0,0,100,50&fit=50x50&format=png", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	img, err = png.Decode(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(25, 50), img.Bounds().Size())
+}
+
+func TestProxy_RectRasterized(t *testing.T) {
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte(`<svg xmlns="http://www.w3.org/2000/svg" width="1000" height="1000"><rect width="1000" height="1000" fill="#ff0000"/></svg>`))
+	}))
+	config.MaxOutputWidth = 100
+	config.MaxOutputHeight = 100
+
+	// The output limits apply to the region rather than to the whole rasterized image.
+	for query, expected := range map[string]image.Point{
+		"?rasterize&rect=0,0,100,50&fit=80x80&format=png": image.Pt(80, 40),
+		"?rasterize&rect=0,0,100,50&format=png":           image.Pt(100, 50),
+		"?rasterize&rect=0,0,500,500&format=png":          image.Pt(100, 100),
+	} {
+		t.Run(query, func(t *testing.T) {
+			result := proxyTestRequest(t, config, server, "/foo.svg"+query, nil)
+			require.Equal(t, http.StatusOK, result.StatusCode)
+			img, err := png.Decode(result.Body)
+			require.NoError(t, err)
+			assert.Equal(t, expected, img.Bounds().Size())
+		})
+	}
+}
+
+func TestNewRequest_Focus(t *testing.T) {
+	for query, valid := range map[string]bool{
+		"fill=10x10&focus=0.25,0.75":           true,
+		"fill=10x10&focus=0,1":                 true,
+		"fill=10x10&focus=0.5":                 false,
+		"fill=10x10&focus=1.5,0":               false,
+		"fill=10x10&focus=foo,0":               false,
+		"fill=10x10&focus=0.5,0.5&crop=center": false,
+	} {
+		t.Run(query, func(t *testing.T) {
+			url, err := url.Parse("/foo.example.com/foo.png?" + query)
+			require.NoError(t, err)
+			_, err = NewRequestFromURL(url)
+			if valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// maxQuantizeSamples bounds the number of pixels inspected when choosing a palette.
+const maxQuantizeSamples = 1 << 16
+
+// medianCutQuantizer is a draw.Quantizer that chooses palette colors using the median cut
+// algorithm. Fully transparent pixels are given a dedicated palette entry.
+type medianCutQuantizer struct{}
+
+var _ draw.Quantizer = medianCutQuantizer{}
+
+type colorCount struct {
+	c     [4]uint8
+	count int
+}
+
+type colorBox []colorCount
+
+func (b colorBox) channelRange(channel int) int {
+	min, max := 255, 0
+	for _, cc := range b {
+		v := int(cc.c[channel])
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return max - min
+}
+
+// widestChannel returns the channel with the largest range in the box, and that range.
+func (b colorBox) widestChannel() (int, int) {
+	channel, width := 0, -1
+	for i := 0; i < 4; i++ {
+		if r := b.channelRange(i); r > width {
+			channel, width = i, r
+		}
+	}
+	return channel, width
+}
+
+func (b colorBox) count() int {
+	n := 0
+	for _, cc := range b {
+		n += cc.count
+	}
+	return n
+}
+
+// split divides the box at the weighted median of its widest channel.
+func (b colorBox) split() (colorBox, colorBox) {
+	channel, _ := b.widestChannel()
+	sort.Slice(b, func(i, j int) bool {
+		return b[i].c[channel] < b[j].c[channel]
+	})
+	half, n := b.count()/2, 0
+	for i, cc := range b[:len(b)-1] {
+		n += cc.count
+		if n >= half {
+			return b[:i+1], b[i+1:]
+		}
+	}
+	return b[:len(b)-1], b[len(b)-1:]
+}
+
+func (b colorBox) mean() color.NRGBA {
+	var sum [4]int
+	n := 0
+	for _, cc := range b {
+		for i := range sum {
+			sum[i] += int(cc.c[i]) * cc.count
+		}
+		n += cc.count
+	}
+	return color.NRGBA{
+		R: uint8((sum[0] + n/2) / n),
+		G: uint8((sum[1] + n/2) / n),
+		B: uint8((sum[2] + n/2) / n),
+		A: uint8((sum[3] + n/2) / n),
+	}
+}
+
+func (medianCutQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	available := cap(p) - len(p)
+	if available < 1 {
+		return p
+	}
+
+	bounds := m.Bounds()
+	step := 1
+	for bounds.Dx()*bounds.Dy()/(step*step) > maxQuantizeSamples {
+		step++
+	}
+
+	counts := map[[4]uint8]int{}
+	transparent := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += step {
+		for x := bounds.Min.X; x < bounds.Max.X; x += step {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				transparent = true
+				continue
+			}
+			counts[[4]uint8{c.R, c.G, c.B, c.A}]++
+		}
+	}
+
+	if transparent {
+		p = append(p, color.NRGBA{})
+		available--
+	}
+	if available < 1 || len(counts) == 0 {
+		return p
+	}
+
+	box := make(colorBox, 0, len(counts))
+	for c, n := range counts {
+		box = append(box, colorCount{c: c, count: n})
+	}
+	// Map iteration order is random. Sort so that the resulting palette is deterministic.
+	sort.Slice(box, func(i, j int) bool {
+		a, b := box[i].c, box[j].c
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	boxes := []colorBox{box}
+	for len(boxes) < available {
+		best, bestScore := -1, 0
+		for i, b := range boxes {
+			if len(b) < 2 {
+				continue
+			}
+			_, width := b.widestChannel()
+			if score := width * b.count(); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	for _, b := range boxes {
+		p = append(p, b.mean())
+	}
+	return p
+}
+
+// quantize converts img to a paletted image of at most n colors with Floyd-Steinberg dithering.
+func quantize(img image.Image, n int) *image.Paletted {
+	bounds := img.Bounds()
+	palette := medianCutQuantizer{}.Quantize(make(color.Palette, 0, n), img)
+	out := image.NewPaletted(bounds, palette)
+	draw.FloydSteinberg.Draw(out, bounds, img, bounds.Min)
+	return out
+}
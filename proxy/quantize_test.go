@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuantize(t *testing.T) {
+	t.Run("FewColors", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+		img.SetNRGBA(0, 0, color.NRGBA{0xff, 0x00, 0x00, 0xff})
+		img.SetNRGBA(1, 0, color.NRGBA{0x00, 0xff, 0x00, 0xff})
+		img.SetNRGBA(2, 0, color.NRGBA{0x00, 0x00, 0xff, 0xff})
+		img.SetNRGBA(3, 0, color.NRGBA{})
+
+		out := quantize(img, 16)
+		require.Len(t, out.Palette, 4)
+		for x := 0; x < 4; x++ {
+			assertColor(t, img.At(x, 0), out.At(x, 0))
+		}
+	})
+
+	t.Run("ManyColors", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+		for y := 0; y < 256; y++ {
+			for x := 0; x < 256; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), 0x80, 0xff})
+			}
+		}
+
+		out := quantize(img, 64)
+		assert.Len(t, out.Palette, 64)
+		assert.Equal(t, img.Bounds(), out.Bounds())
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				img.SetNRGBA(x, y, color.NRGBA{uint8(x * 4), uint8(y * 4), uint8(x * y), 0xff})
+			}
+		}
+
+		assert.Equal(t, quantize(img, 32).Palette, quantize(img, 32).Palette)
+	})
+}
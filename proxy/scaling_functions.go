@@ -18,6 +18,9 @@ const (
 	CropTypeBottomLeft  CropType = "bottom_left"
 	CropTypeBottom      CropType = "bottom"
 	CropTypeBottomRight CropType = "bottom_right"
+
+	// CropTypeSmart chooses the crop based on the content of the image. See smartFocus.
+	CropTypeSmart CropType = "smart"
 )
 
 var cropTypeToAnchor = map[CropType]imaging.Anchor{
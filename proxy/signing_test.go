@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignURL(t *testing.T) {
+	unsigned, err := url.Parse("/foo.example.com/foo.png?fit=100x100&format=jpg")
+	require.NoError(t, err)
+
+	newRequest := func(u *url.URL) *Request {
+		r, err := NewRequestFromURL(u)
+		require.NoError(t, err)
+		return r
+	}
+
+	config := &Configuration{
+		SigningKeys: [][]byte{[]byte("new"), []byte("old")},
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		assert.NoError(t, config.VerifySignature(newRequest(SignURL([]byte("new"), unsigned, time.Time{}))))
+	})
+
+	t.Run("RotatedKey", func(t *testing.T) {
+		assert.NoError(t, config.VerifySignature(newRequest(SignURL([]byte("old"), unsigned, time.Time{}))))
+	})
+
+	t.Run("ReorderedQuery", func(t *testing.T) {
+		signed := SignURL([]byte("new"), unsigned, time.Time{})
+		reordered, err := url.Parse(signed.Path + "?signature=" + signed.Query().Get("signature") + "&format=jpg&fit=100x100")
+		require.NoError(t, err)
+		assert.NoError(t, config.VerifySignature(newRequest(reordered)))
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		assert.Error(t, config.VerifySignature(newRequest(unsigned)))
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		assert.Error(t, config.VerifySignature(newRequest(SignURL([]byte("wrong"), unsigned, time.Time{}))))
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		signed := SignURL([]byte("new"), unsigned, time.Time{})
+		query := signed.Query()
+		query.Set("fit", "10000x10000")
+		signed.RawQuery = query.Encode()
+		assert.Error(t, config.VerifySignature(newRequest(signed)))
+	})
+
+	t.Run("NotExpired", func(t *testing.T) {
+		signed := SignURL([]byte("new"), unsigned, time.Now().Add(time.Hour))
+		assert.NoError(t, config.VerifySignature(newRequest(signed)))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		signed := SignURL([]byte("new"), unsigned, time.Now().Add(-time.Hour))
+		assert.Error(t, config.VerifySignature(newRequest(signed)))
+	})
+
+	t.Run("NoKeys", func(t *testing.T) {
+		assert.NoError(t, (&Configuration{}).VerifySignature(newRequest(unsigned)))
+	})
+
+	t.Run("EmptyKey", func(t *testing.T) {
+		config := &Configuration{
+			SigningKeys: [][]byte{{}},
+		}
+		assert.Error(t, config.VerifySignature(newRequest(SignURL(nil, unsigned, time.Time{}))))
+	})
+}
+
+func TestConfiguration_LoadEnvironmentVariables_SigningKeys(t *testing.T) {
+	defer os.Unsetenv("IMAGE_PROXY_SIGNING_KEYS")
+
+	os.Setenv("IMAGE_PROXY_SIGNING_KEYS", " new, ,old,")
+	config := &Configuration{}
+	require.NoError(t, config.LoadEnvironmentVariables())
+	assert.Equal(t, [][]byte{[]byte("new"), []byte("old")}, config.SigningKeys)
+
+	os.Setenv("IMAGE_PROXY_SIGNING_KEYS", ",")
+	assert.Error(t, (&Configuration{}).LoadEnvironmentVariables())
+}
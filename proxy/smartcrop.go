@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// These parameters follow smartcrop.js.
+const (
+	// smartCropAnalysisSize is the maximum width and height of the image that crops are scored on.
+	smartCropAnalysisSize = 128
+
+	smartCropDetailWeight     = 0.2
+	smartCropSkinWeight       = 1.8
+	smartCropSkinBias         = 0.01
+	smartCropSkinThreshold    = 0.8
+	smartCropSaturationWeight = 0.1
+	smartCropSaturationBias   = 0.2
+	smartCropSaturationMin    = 0.4
+
+	// smartCropOutsideImportance is the weight of features outside of a crop, which penalizes
+	// crops that cut off interesting parts of the image.
+	smartCropOutsideImportance = -0.5
+	smartCropEdgeRadius        = 0.4
+	smartCropEdgeWeight        = -20.0
+)
+
+// smartCropSkinColor is the normalized color that skin tones are compared to.
+var smartCropSkinColor = [3]float64{0.78, 0.57, 0.44}
+
+// smartCropFeatures are the per-pixel features of an image that crops are scored on, each ranging
+// from 0 to 1.
+type smartCropFeatures struct {
+	width, height int
+	detail        []float64
+	skin          []float64
+	saturation    []float64
+}
+
+// smartFocus chooses the focal point for cropping img to the aspect ratio of the given dimensions.
+// Like smartcrop.js, it scores every candidate crop on the edges, skin tones, and saturated colors
+// it contains, favoring crops that place them near the center and on the thirds lines. Ties go to
+// the first candidate, so the result is deterministic.
+func smartFocus(img image.Image, width, height int) *FocalPoint {
+	bounds := img.Bounds()
+	analysisWidth, analysisHeight := bounds.Dx(), bounds.Dy()
+	if analysisWidth > smartCropAnalysisSize || analysisHeight > smartCropAnalysisSize {
+		analysisWidth, analysisHeight = ScaleToFit(smartCropAnalysisSize, smartCropAnalysisSize)(analysisWidth, analysisHeight, false)
+	}
+	if analysisWidth < 1 || analysisHeight < 1 || width < 1 || height < 1 {
+		return &FocalPoint{0.5, 0.5}
+	}
+	features := newSmartCropFeatures(imaging.Resize(img, analysisWidth, analysisHeight, imaging.Linear))
+
+	// The crop is the largest window with the output's aspect ratio.
+	aspect := float64(width) / float64(height)
+	cropWidth, cropHeight := analysisWidth, int(math.Round(float64(analysisWidth)/aspect))
+	if cropHeight > analysisHeight {
+		cropWidth, cropHeight = int(math.Round(float64(analysisHeight)*aspect)), analysisHeight
+	}
+	if cropWidth < 1 {
+		cropWidth = 1
+	}
+	if cropHeight < 1 {
+		cropHeight = 1
+	}
+
+	var best image.Rectangle
+	bestScore := math.Inf(-1)
+	for _, y := range smartCropOffsets(analysisHeight - cropHeight) {
+		for _, x := range smartCropOffsets(analysisWidth - cropWidth) {
+			crop := image.Rect(x, y, x+cropWidth, y+cropHeight)
+			if score := features.score(crop); score > bestScore {
+				best, bestScore = crop, score
+			}
+		}
+	}
+
+	return &FocalPoint{
+		X: (float64(best.Min.X) + float64(best.Dx())/2) / float64(analysisWidth),
+		Y: (float64(best.Min.Y) + float64(best.Dy())/2) / float64(analysisHeight),
+	}
+}
+
+// smartCropOffsets returns the candidate offsets of a crop that can move by up to extent pixels.
+func smartCropOffsets(extent int) []int {
+	step := extent / 32
+	if step < 1 {
+		step = 1
+	}
+	var offsets []int
+	for offset := 0; offset < extent; offset += step {
+		offsets = append(offsets, offset)
+	}
+	return append(offsets, extent)
+}
+
+func newSmartCropFeatures(img *image.NRGBA) *smartCropFeatures {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	f := &smartCropFeatures{
+		width:      width,
+		height:     height,
+		detail:     make([]float64, width*height),
+		skin:       make([]float64, width*height),
+		saturation: make([]float64, width*height),
+	}
+
+	lightness := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			r := float64(img.Pix[i]) / 255
+			g := float64(img.Pix[i+1]) / 255
+			b := float64(img.Pix[i+2]) / 255
+			l := 0.2126*r + 0.7152*g + 0.0722*b
+			lightness[y*width+x] = l
+			f.skin[y*width+x] = skinTone(r, g, b, l)
+			f.saturation[y*width+x] = colorSaturation(r, g, b)
+		}
+	}
+
+	// Details are edges, found with a Laplacian filter. Pixels past the borders repeat the border.
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		} else if x >= width {
+			x = width - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= height {
+			y = height - 1
+		}
+		return lightness[y*width+x]
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			edge := 4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1)
+			f.detail[y*width+x] = math.Min(math.Abs(edge), 1)
+		}
+	}
+
+	return f
+}
+
+// skinTone returns how closely a color resembles skin.
+func skinTone(r, g, b, lightness float64) float64 {
+	magnitude := math.Sqrt(r*r + g*g + b*b)
+	if magnitude == 0 || lightness < 0.2 {
+		return 0
+	}
+	dr := r/magnitude - smartCropSkinColor[0]
+	dg := g/magnitude - smartCropSkinColor[1]
+	db := b/magnitude - smartCropSkinColor[2]
+	similarity := 1 - math.Sqrt(dr*dr+dg*dg+db*db)
+	if similarity <= smartCropSkinThreshold {
+		return 0
+	}
+	return (similarity - smartCropSkinThreshold) / (1 - smartCropSkinThreshold)
+}
+
+// colorSaturation returns how saturated a color is, ignoring colors that are nearly black or white.
+func colorSaturation(r, g, b float64) float64 {
+	hi := math.Max(r, math.Max(g, b))
+	lo := math.Min(r, math.Min(g, b))
+	lightness := (hi + lo) / 2
+	if hi == lo || lightness < 0.05 || lightness > 0.9 {
+		return 0
+	}
+	s := (hi - lo) / (hi + lo)
+	if lightness > 0.5 {
+		s = (hi - lo) / (2 - hi - lo)
+	}
+	if s <= smartCropSaturationMin {
+		return 0
+	}
+	return (s - smartCropSaturationMin) / (1 - smartCropSaturationMin)
+}
+
+// score returns the score of a crop. Higher is better.
+func (f *smartCropFeatures) score(crop image.Rectangle) float64 {
+	var detail, skin, saturation float64
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			i := y*f.width + x
+			importance := smartCropImportance(crop, x, y)
+			d := f.detail[i]
+			detail += d * importance
+			skin += f.skin[i] * (d + smartCropSkinBias) * importance
+			saturation += f.saturation[i] * (d + smartCropSaturationBias) * importance
+		}
+	}
+	total := detail*smartCropDetailWeight + skin*smartCropSkinWeight + saturation*smartCropSaturationWeight
+	return total / float64(crop.Dx()*crop.Dy())
+}
+
+// smartCropImportance returns the weight of a pixel's features in the score of a crop. Pixels near
+// the center and the thirds lines of the crop are the most important, and those near its edges are
+// the least.
+func smartCropImportance(crop image.Rectangle, x, y int) float64 {
+	if !(image.Point{x, y}).In(crop) {
+		return smartCropOutsideImportance
+	}
+	px := math.Abs(0.5-(float64(x-crop.Min.X)+0.5)/float64(crop.Dx())) * 2
+	py := math.Abs(0.5-(float64(y-crop.Min.Y)+0.5)/float64(crop.Dy())) * 2
+	dx := math.Max(px-1+smartCropEdgeRadius, 0)
+	dy := math.Max(py-1+smartCropEdgeRadius, 0)
+	d := (dx*dx + dy*dy) * smartCropEdgeWeight
+	s := 1.41 - math.Sqrt(px*px+py*py)
+	s += math.Max(0, s+d+0.5) * 1.2 * (thirds(px) + thirds(py))
+	return s + d
+}
+
+// thirds peaks where x, a distance from the center of a crop relative to its half-size, is on one
+// of the crop's thirds lines.
+func thirds(x float64) float64 {
+	x = (math.Mod(x-1.0/3+1, 2)*0.5 - 0.5) * 16
+	return math.Max(1-x*x, 0)
+}
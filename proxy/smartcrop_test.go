@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSmartFocus(t *testing.T) {
+	for name, tc := range map[string]struct {
+		Image  string
+		Width  int
+		Height int
+		Check  func(t *testing.T, focus *FocalPoint)
+	}{
+		"Right": {
+			Image:  "400x200-subject-right.png",
+			Width:  100,
+			Height: 100,
+			Check: func(t *testing.T, focus *FocalPoint) {
+				assert.True(t, focus.X > 0.7, "expected the focus on the right, got %v", focus.X)
+			},
+		},
+		"Bottom": {
+			Image:  "200x400-subject-bottom.png",
+			Width:  100,
+			Height: 100,
+			Check: func(t *testing.T, focus *FocalPoint) {
+				assert.True(t, focus.Y > 0.7, "expected the focus at the bottom, got %v", focus.Y)
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := png.Decode(bytes.NewReader(getImage(tc.Image)))
+			require.NoError(t, err)
+			focus := smartFocus(img, tc.Width, tc.Height)
+			tc.Check(t, focus)
+			assert.Equal(t, focus, smartFocus(img, tc.Width, tc.Height))
+		})
+	}
+}
+
+func TestScalingFilter_SmartCrop(t *testing.T) {
+	smart := CropTypeSmart
+	center := CropTypeCenter
+	skin := func(img image.Image, x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r>>8 > 200 && g>>8 > 150 && g>>8 < 190 && b>>8 > 120 && b>>8 < 160
+	}
+
+	for name, tc := range map[string]struct {
+		Image string
+		Face  image.Point
+	}{
+		"Right": {
+			// The face is at (320, 100) of the source, which is scaled to 200x100 and cropped to the
+			// right half.
+			Image: "400x200-subject-right.png",
+			Face:  image.Pt(60, 55),
+		},
+		"Bottom": {
+			Image: "200x400-subject-bottom.png",
+			Face:  image.Pt(50, 65),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, filterErr := ScalingFilter(&ScalingOptions{Fill: &Dimensions{100, 100}, Crop: &smart})(getResponse(tc.Image))
+			require.Nil(t, filterErr)
+			frame := out.Image.Frames[0]
+			assert.Equal(t, image.Rect(0, 0, 100, 100), frame.Bounds())
+			assert.True(t, skin(frame, tc.Face.X, tc.Face.Y), "expected the face at %v", tc.Face)
+
+			// A centered crop cuts off most of the face.
+			out, filterErr = ScalingFilter(&ScalingOptions{Fill: &Dimensions{100, 100}, Crop: &center})(getResponse(tc.Image))
+			require.Nil(t, filterErr)
+			assert.False(t, skin(out.Image.Frames[0], tc.Face.X, tc.Face.Y))
+		})
+	}
+}
+
+func TestProxy_SmartCrop(t *testing.T) {
+	server, config := newTestOrigin(t, serveTestImage("400x200-subject-right.png"))
+	result := proxyTestRequest(t, config, server, "/foo.png?fill=100x100&crop=smart", nil)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	img, err := png.Decode(result.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Pt(100, 100), img.Bounds().Size())
+}
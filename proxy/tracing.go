@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the proxy's spans.
+const tracerName = "github.com/theaaf/image-proxy/proxy"
+
+// NewTracerProvider creates a tracer provider for Configuration.TracerProvider that exports spans
+// with the named exporter. "otlp" sends them to an OpenTelemetry collector over HTTP, as configured
+// by the standard OTEL_EXPORTER_OTLP_* environment variables. "stdout" writes them to stdout, which
+// is useful for local testing.
+func NewTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	switch exporter {
+	case "otlp":
+		e, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(e)), nil
+	case "stdout":
+		e, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, err
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithSyncer(e)), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter: %v", exporter)
+}
+
+// ExtractTraceContext returns a copy of ctx with the trace context given by the W3C traceparent and
+// tracestate headers, if any, so that a request's spans join the client's trace.
+func ExtractTraceContext(ctx context.Context, header http.Header) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+func (c *Configuration) tracer() trace.Tracer {
+	if c.TracerProvider == nil {
+		return noop.NewTracerProvider().Tracer(tracerName)
+	}
+	return c.TracerProvider.Tracer(tracerName)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	provider, err := NewTracerProvider("stdout")
+	require.NoError(t, err)
+	assert.NoError(t, provider.Shutdown(context.Background()))
+
+	_, err = NewTracerProvider("foo")
+	assert.Error(t, err)
+}
+
+func TestProxy_Tracing(t *testing.T) {
+	image := serveTestImage("200x100.png")
+	server, config := newTestOrigin(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		image.ServeHTTP(w, r)
+	}))
+	recorder := tracetest.NewSpanRecorder()
+	config.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	proxy := func(path string) []sdktrace.ReadOnlySpan {
+		u, err := url.Parse("/" + strings.TrimPrefix(server.URL, "https://") + path)
+		require.NoError(t, err)
+		request, err := NewRequest(u, nil)
+		require.NoError(t, err)
+
+		header := http.Header{"Traceparent": []string{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+		ctx := ExtractTraceContext(context.Background(), header)
+		Proxy(ctx, config, httptest.NewRecorder(), request)
+
+		spans := recorder.Ended()
+		recorder.Reset()
+		return spans
+	}
+
+	spans := proxy("/foo.png?fit=100x100&format=png")
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String())
+	}
+	assert.Equal(t, []string{"origin fetch", "filter contenttype", "filter orientation", "filter scaling", "filter png", "filter encode", "filter header", "write", "proxy"}, names)
+
+	root := spans[len(spans)-1]
+	assert.Equal(t, "b7ad6b7169203331", root.Parent().SpanID().String())
+	assert.True(t, root.Parent().IsRemote())
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID())
+	}
+
+	spans = proxy("/missing.png")
+	require.Len(t, spans, 2)
+	assert.Equal(t, "origin fetch", spans[0].Name())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "proxy", spans[1].Name())
+	assert.NotEmpty(t, spans[1].Events())
+}
@@ -1,10 +1,12 @@
 package svg
 
 // #cgo LDFLAGS: -lrsvg-2
+// #include <stdlib.h>
 // #include <librsvg/rsvg.h>
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -23,10 +25,16 @@ func (e rsvgError) Error() string {
 	return C.GoString((*C.char)(e.err.message))
 }
 
+// New parses an SVG document. The SVG must be closed when it's no longer needed.
 func New(data []byte) (*SVG, error) {
+	// The data is parsed before rsvg_handle_new_from_data returns, so it doesn't need to outlive the
+	// call.
+	cData := C.CBytes(data)
+	defer C.free(cData)
+
 	var err *C.GError
 	svg := &SVG{
-		handle: C.rsvg_handle_new_from_data((*C.guint8)(C.CBytes(data)), C.gsize(len(data)), &err),
+		handle: C.rsvg_handle_new_from_data((*C.guint8)(cData), C.gsize(len(data)), &err),
 	}
 	if err != nil {
 		return nil, &rsvgError{
@@ -36,13 +44,41 @@ func New(data []byte) (*SVG, error) {
 	return svg, nil
 }
 
-func (svg *SVG) Rasterize(scalingFunction func(width, height int, allowUpscaling bool) (int, int)) (image.Image, error) {
+// Close releases the SVG's resources.
+func (svg *SVG) Close() {
+	if svg.handle != nil {
+		C.g_object_unref(C.gpointer(svg.handle))
+		svg.handle = nil
+	}
+}
+
+// ErrTooLarge is returned by Rasterize if the render surface would exceed the maximum size.
+var ErrTooLarge = errors.New("render surface too large")
+
+type RasterizeOptions struct {
+	// ScalingFunction determines the output dimensions from the SVG's natural dimensions. If nil,
+	// the natural dimensions are used.
+	ScalingFunction func(width, height int, allowUpscaling bool) (int, int)
+
+	// AllowUpscaling is passed to ScalingFunction to permit output dimensions larger than the
+	// SVG's natural dimensions.
+	AllowUpscaling bool
+
+	// MaxPixels limits the number of pixels in the render surface. Zero means no limit.
+	MaxPixels int
+}
+
+func (svg *SVG) Rasterize(opts *RasterizeOptions) (image.Image, error) {
 	var dimensions C.RsvgDimensionData
 	C.rsvg_handle_get_dimensions(svg.handle, &dimensions)
 
 	width, height := int(dimensions.width), int(dimensions.height)
-	if scalingFunction != nil {
-		width, height = scalingFunction(int(dimensions.width), int(dimensions.height), true)
+	if opts.ScalingFunction != nil {
+		width, height = opts.ScalingFunction(int(dimensions.width), int(dimensions.height), opts.AllowUpscaling)
+	}
+
+	if opts.MaxPixels > 0 && int64(width)*int64(height) > int64(opts.MaxPixels) {
+		return nil, ErrTooLarge
 	}
 
 	surface := C.cairo_image_surface_create(C.CAIRO_FORMAT_ARGB32, C.int(width), C.int(height))
@@ -22,8 +22,12 @@ var validSVG = `<?xml version="1.0" encoding="UTF-8" standalone="no"?>
 func TestNew(t *testing.T) {
 	t.Run("ValidInput", func(t *testing.T) {
 		svg, err := New([]byte(validSVG))
-		assert.NoError(t, err)
+		require.NoError(t, err)
 		assert.NotNil(t, svg)
+
+		// Closing more than once is harmless.
+		svg.Close()
+		svg.Close()
 	})
 
 	t.Run("InvalidInput", func(t *testing.T) {